@@ -4,33 +4,101 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/fs"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
-	// needed driver.
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgx/v4"
 	"github.com/spf13/cobra"
 
 	"github.com/stack11/trek/internal"
 )
 
+var errConflictingConnectionFlags = errors.New("--dsn can't be combined with the other connection flags")
+
+type postgresConnectionFlags struct {
+	connString string
+	host       string
+	port       int
+	user       string
+	password   string
+	sslMode    string
+}
+
+func (f *postgresConnectionFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.connString, "dsn", "", "Connection string of the PostgreSQL database, either a URL or key/value pairs") //nolint:lll
+	cmd.Flags().StringVar(&f.host, "postgres-host", "", "Host of the PostgreSQL database")
+	cmd.Flags().IntVar(&f.port, "postgres-port", 0, "Port of the PostgreSQL database")
+	cmd.Flags().StringVar(&f.user, "postgres-user", "", "User of the PostgreSQL database")
+	cmd.Flags().StringVar(&f.password, "postgres-password", "", "Password of the PostgreSQL database")
+	cmd.Flags().StringVar(&f.sslMode, "postgres-sslmode", "", "SSL Mode of the PostgreSQL database (default \"disable\")")
+}
+
+// dsn returns the connection string of the database. Settings which are neither part of --dsn nor passed as flags are
+// taken from the PG* environment variables, the password file and the service file, like by libpq.
+func (f *postgresConnectionFlags) dsn(database string) (string, error) {
+	if f.connString != "" {
+		if f.host != "" || f.port != 0 || f.user != "" || f.password != "" || f.sslMode != "" {
+			return "", errConflictingConnectionFlags
+		}
+
+		return internal.DSNWithParameters(f.connString, map[string]string{"dbname": database})
+	}
+
+	sslMode := f.sslMode
+	if sslMode == "" && os.Getenv("PGSSLMODE") == "" {
+		sslMode = "disable"
+	}
+	parameters := map[string]string{
+		"host":     f.host,
+		"user":     f.user,
+		"password": f.password,
+		"sslmode":  sslMode,
+		"dbname":   database,
+	}
+	if f.port != 0 {
+		parameters["port"] = strconv.Itoa(f.port)
+	}
+
+	return internal.DSNWithParameters("", parameters)
+}
+
+// config returns the parsed connection config of the database, which identifies trek as the application.
+func (f *postgresConnectionFlags) config(database string) (*pgx.ConnConfig, error) {
+	dsn, err := f.dsn(database)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	if _, ok := config.RuntimeParams["application_name"]; !ok {
+		config.RuntimeParams["application_name"] = "trek"
+	}
+
+	return config, nil
+}
+
 //nolint:gocognit,cyclop
 func NewApplyCommand() *cobra.Command {
 	var (
-		postgresHost     string
-		postgresPort     int
-		postgresUser     string
-		postgresPassword string
-		postgresSSLMode  string
+		connectionFlags  postgresConnectionFlags
 		resetDatabase    bool
 		insertTestData   bool
+		testdataSet      string
+		toVersion        uint
+		dryRun           bool
+		lockWaitTimeout  time.Duration
+		waitTimeout      time.Duration
+		connectRetries   int
+		statementTimeout time.Duration
+		lockTimeout      time.Duration
 	)
 
 	applyCmd := &cobra.Command{
@@ -52,18 +120,68 @@ func NewApplyCommand() *cobra.Command {
 				return fmt.Errorf("failed to read config: %w", err)
 			}
 
-			conn, err := pgx.Connect(ctx, fmt.Sprintf(
-				"postgres://%s:%s@%s:%d/%s?sslmode=%s",
-				postgresUser,
-				postgresPassword,
-				postgresHost,
-				postgresPort,
-				"postgres", // We need to connect to the default database in order to drop and create the actual database
-				postgresSSLMode,
-			))
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+
+			firstVersion := internal.GetFirstMigrationVersion(migrationFiles)
+			latestVersion := internal.GetLatestMigrationVersion(migrationFiles)
+			if toVersion > latestVersion {
+				//nolint:goerr113
+				return fmt.Errorf("target version %d does not exist, latest version is %d", toVersion, latestVersion)
+			}
+			if toVersion > 0 && toVersion < firstVersion {
+				//nolint:goerr113
+				return fmt.Errorf("target version %d has been squashed into %q", toVersion, migrationFiles[0])
+			}
+			if toVersion > 0 {
+				migrationFiles = migrationFiles[:toVersion-firstVersion+1]
+			}
+
+			// We need to connect to the default database in order to drop and create the actual database
+			maintenanceConfig, err := connectionFlags.config("postgres")
+			if err != nil {
+				return err
+			}
+			conn, err := internal.ConnectWithRetry(ctx, maintenanceConfig, connectRetries, waitTimeout)
 			if err != nil {
 				return fmt.Errorf("failed to connect to database: %w", err)
 			}
+			defer func() {
+				_ = conn.Close(ctx)
+			}()
+
+			if dryRun {
+				return printApplyPlan(ctx, conn, &applyPlanOptions{
+					wd:              wd,
+					config:          config,
+					connectionFlags: &connectionFlags,
+					migrationsDir:   migrationsDir,
+					migrationFiles:  migrationFiles,
+					resetDatabase:   resetDatabase,
+					insertTestData:  insertTestData,
+					testdataSet:     testdataSet,
+				})
+			}
+
+			// The lock is held on the default database for the whole operation, so concurrent deploys of the same
+			// database run one after another
+			unlock, err := internal.AcquireAdvisoryLock(
+				ctx,
+				conn,
+				internal.AdvisoryLockKey(config.DatabaseName),
+				lockWaitTimeout,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to lock database %q: %w", config.DatabaseName, err)
+			}
+			defer unlock()
 
 			if resetDatabase {
 				log.Println("Resetting database")
@@ -107,39 +225,54 @@ func NewApplyCommand() *cobra.Command {
 				}
 			}
 
-			err = conn.Close(ctx)
+			dsn, err := connectionFlags.dsn(config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			databaseConfig, err := connectionFlags.config(config.DatabaseName)
 			if err != nil {
-				return fmt.Errorf("failed to close database connection: %w", err)
+				return err
 			}
 
-			dsn := fmt.Sprintf(
-				"postgres://%s:%s@%s:%d/%s?sslmode=%s",
-				postgresUser,
-				postgresPassword,
-				postgresHost,
-				postgresPort,
-				config.DatabaseName,
-				postgresSSLMode,
-			)
+			migrateConfig := databaseConfig.Copy()
+			setSessionTimeouts(migrateConfig, statementTimeout, lockTimeout)
+			m, closeMigrate, err := internal.NewMigrate(migrationsDir, migrateConfig)
+			if err != nil {
+				return err
+			}
+			defer closeMigrate()
 
-			migrationsDir, err := internal.GetMigrationsDir(wd)
+			databaseConn, err := pgx.ConnectConfig(ctx, databaseConfig)
 			if err != nil {
-				return fmt.Errorf("failed to get migrations directory: %w", err)
+				return fmt.Errorf("failed to connect to database: %w", err)
 			}
+			defer func() {
+				_ = databaseConn.Close(ctx)
+			}()
 
-			m, err := migrate.New(fmt.Sprintf("file://%s", migrationsDir), dsn)
+			err = internal.EnsureChecksumTable(ctx, databaseConn)
+			if err != nil {
+				return err
+			}
+			err = internal.VerifyAppliedChecksums(ctx, databaseConn, migrationsDir, migrationFiles)
 			if err != nil {
-				return fmt.Errorf("failed to initialize go-migrate: %w", err)
+				return err
 			}
 
-			if resetDatabase || !databaseExists {
-				var migrationFiles []string
-				migrationFiles, err = internal.FindMigrations(migrationsDir, true)
+			if databaseExists {
+				var currentVersion uint
+				currentVersion, _, err = m.Version()
+				if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+					return fmt.Errorf("failed to get current version: %w", err)
+				}
+				err = internal.VerifyNotSquashed(currentVersion, migrationsDir, migrationFiles)
 				if err != nil {
-					return fmt.Errorf("failed to read migrations: %w", err)
+					return err
 				}
+			}
 
-				for index, file := range migrationFiles {
+			if resetDatabase || !databaseExists {
+				for _, file := range migrationFiles {
 					log.Printf("Applying migration %q\n", file)
 					err = m.Steps(1)
 					if errors.Is(err, migrate.ErrNoChange) {
@@ -148,24 +281,21 @@ func NewApplyCommand() *cobra.Command {
 						return fmt.Errorf("failed to apply migration %q: %w", file, err)
 					}
 					if insertTestData {
-						err = filepath.Walk(filepath.Join(wd, "testdata"), func(p string, info fs.FileInfo, err error) error {
-							if strings.HasPrefix(path.Base(p), fmt.Sprintf("%03d", index+1)) {
-								log.Printf("Inserting testdata %q\n", path.Base(p))
-
-								// We have to use psql, because users might use commands like "\copy"
-								// which don't work by directly connecting to the database
-								err := internal.PsqlFile(dsn, p)
-								if err != nil {
-									return fmt.Errorf("failed to insert testdata: %w", err)
-								}
-
-								return nil
-							}
+						var testdataFiles []string
+						testdataFiles, err = internal.FindTestdataFiles(
+							filepath.Join(wd, "testdata"),
+							testdataSet,
+							int(internal.GetMigrationNumber(file)),
+						)
+						if err != nil {
+							return err
+						}
 
-							return nil
+						err = internal.InsertTestdata(ctx, dsn, testdataFiles, func(file string) {
+							log.Printf("Inserting testdata %q\n", filepath.Base(file))
 						})
 						if err != nil {
-							return fmt.Errorf("failed to run testdata: %w", err)
+							return fmt.Errorf("failed to insert testdata: %w", err)
 						}
 					}
 				}
@@ -174,6 +304,11 @@ func NewApplyCommand() *cobra.Command {
 				if err != nil {
 					return fmt.Errorf("failed to run hook: %w", err)
 				}
+			} else if toVersion > 0 {
+				err = migrateTo(m, toVersion)
+				if err != nil {
+					return err
+				}
 			} else {
 				err = m.Up()
 				if errors.Is(err, migrate.ErrNoChange) {
@@ -183,40 +318,199 @@ func NewApplyCommand() *cobra.Command {
 				}
 			}
 
-			conn, err = pgx.Connect(ctx, dsn)
+			version, dirty, err := m.Version()
+			if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+				return fmt.Errorf("failed to get current version: %w", err)
+			}
+			if dirty && version > 0 {
+				version--
+			}
+			err = internal.RecordAppliedChecksums(ctx, databaseConn, migrationsDir, migrationFiles, version)
 			if err != nil {
-				return fmt.Errorf("failed to connect to database: %w", err)
+				return err
 			}
 
 			for _, u := range config.DatabaseUsers {
-				_, err = conn.Exec(ctx, fmt.Sprintf("GRANT SELECT ON public.schema_migrations TO %q", u))
-				if err != nil {
-					return fmt.Errorf("failed to grant select permission on schema_migrations to %q: %w", u, err)
+				for _, table := range []string{"schema_migrations", internal.ChecksumTable} {
+					_, err = databaseConn.Exec(ctx, fmt.Sprintf("GRANT SELECT ON public.%s TO %q", table, u))
+					if err != nil {
+						return fmt.Errorf("failed to grant select permission on %s to %q: %w", table, u, err)
+					}
 				}
 			}
 
-			err = conn.Close(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to close database connection: %w", err)
-			}
-
 			log.Println("Successfully migrated database")
 
 			return nil
 		},
 	}
 
-	applyCmd.Flags().StringVar(&postgresHost, "postgres-host", "", "Host of the PostgreSQL database")
-	applyCmd.Flags().IntVar(&postgresPort, "postgres-port", 0, "Port of the PostgreSQL database")
-	applyCmd.Flags().StringVar(&postgresUser, "postgres-user", "", "User of the PostgreSQL database")
-	applyCmd.Flags().StringVar(&postgresPassword, "postgres-password", "", "Password of the PostgreSQL database")
-	applyCmd.Flags().StringVar(&postgresSSLMode, "postgres-sslmode", "disable", "SSL Mode of the PostgreSQL database")
+	connectionFlags.register(applyCmd)
 	applyCmd.Flags().BoolVar(&resetDatabase, "reset-database", false, "Reset the database before applying migrations")
 	applyCmd.Flags().BoolVar(&insertTestData, "insert-test-data", false, "Insert the testdata of each migration after the individual migrations has been applied") //nolint:lll
-	internal.MarkFlagRequired(applyCmd, "postgres-host")
-	internal.MarkFlagRequired(applyCmd, "postgres-port")
-	internal.MarkFlagRequired(applyCmd, "postgres-user")
-	internal.MarkFlagRequired(applyCmd, "postgres-password")
+	applyCmd.Flags().StringVar(&testdataSet, "testdata-set", "", "Also insert the testdata of this set")
+	applyCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what would be done without changing the database")
+	applyCmd.Flags().DurationVar(&lockWaitTimeout, "lock-wait-timeout", 10*time.Minute, "How long to wait for a concurrent apply to finish")
+	applyCmd.Flags().DurationVar(&waitTimeout, "wait-timeout", 0, "How long to retry connecting until the database accepts connections") //nolint:lll
+	applyCmd.Flags().IntVar(&connectRetries, "connect-retries", 0, "How often to retry connecting to the database")
+	applyCmd.Flags().DurationVar(&statementTimeout, "statement-timeout", 0, "Statement timeout of the migrations, 0 disables it") //nolint:lll
+	applyCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", 0, "Lock timeout of the migrations, 0 disables it")
+	applyCmd.Flags().UintVar(&toVersion, "to", 0, "Only apply the migrations up to and including this version. Defaults to the latest version") //nolint:lll
 
 	return applyCmd
 }
+
+// setSessionTimeouts sets the statement and lock timeout on the sessions of the config.
+func setSessionTimeouts(config *pgx.ConnConfig, statementTimeout, lockTimeout time.Duration) {
+	if statementTimeout > 0 {
+		config.RuntimeParams["statement_timeout"] = strconv.FormatInt(statementTimeout.Milliseconds(), 10)
+	}
+	if lockTimeout > 0 {
+		config.RuntimeParams["lock_timeout"] = strconv.FormatInt(lockTimeout.Milliseconds(), 10)
+	}
+}
+
+// migrateTo migrates the database forward to version. Going backwards is left to the rollback command.
+func migrateTo(m *migrate.Migrate, version uint) error {
+	currentVersion, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return fmt.Errorf("failed to get current version: %w", err)
+	}
+	if dirty {
+		//nolint:goerr113
+		return fmt.Errorf("database is dirty at version %d", currentVersion)
+	}
+	if currentVersion > version {
+		//nolint:goerr113
+		return fmt.Errorf(
+			"database is at version %d which is newer than version %d, use the rollback command instead",
+			currentVersion,
+			version,
+		)
+	}
+
+	err = m.Migrate(version)
+	if errors.Is(err, migrate.ErrNoChange) {
+		log.Println("No changes!")
+	} else if err != nil {
+		return fmt.Errorf("failed to apply migrations up to version %d: %w", version, err)
+	}
+
+	return nil
+}
+
+type applyPlanOptions struct {
+	wd              string
+	config          *internal.Config
+	connectionFlags *postgresConnectionFlags
+	migrationsDir   string
+	migrationFiles  []string
+	resetDatabase   bool
+	insertTestData  bool
+	testdataSet     string
+}
+
+// printApplyPlan prints the actions the apply command would take, without executing any of them.
+//
+//nolint:gocognit,cyclop
+func printApplyPlan(ctx context.Context, conn *pgx.Conn, options *applyPlanOptions) error {
+	fmt.Println("Plan:")
+
+	databaseExists, err := internal.CheckDatabaseExists(ctx, conn, options.config.DatabaseName)
+	if err != nil {
+		return fmt.Errorf("failed to check if database exists: %w", err)
+	}
+
+	if options.resetDatabase {
+		fmt.Println("- Run hook \"apply-reset-pre\"")
+		if databaseExists {
+			fmt.Printf("- Drop database %q\n", options.config.DatabaseName)
+		}
+	}
+	if options.resetDatabase || !databaseExists {
+		fmt.Printf("- Create database %q\n", options.config.DatabaseName)
+	}
+
+	for _, u := range options.config.DatabaseUsers {
+		var userExists bool
+		userExists, err = internal.CheckUserExists(ctx, conn, u)
+		if err != nil {
+			return fmt.Errorf("failed to check if user exists: %w", err)
+		}
+		if !userExists {
+			fmt.Printf("- Create role %q\n", u)
+		}
+	}
+
+	var version uint
+	if databaseExists && !options.resetDatabase {
+		var dirty bool
+		version, dirty, err = getDatabaseVersion(ctx, options.connectionFlags, options.config.DatabaseName)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			//nolint:goerr113
+			return fmt.Errorf("database is dirty at version %d", version)
+		}
+		fmt.Printf("- Database is at version %d\n", version)
+		fmt.Println("- Verify the checksums of the applied migrations")
+	}
+
+	latestVersion := internal.GetLatestMigrationVersion(options.migrationFiles)
+	if version > latestVersion {
+		//nolint:goerr113
+		return fmt.Errorf(
+			"database is at version %d which is newer than version %d",
+			version,
+			latestVersion,
+		)
+	}
+	err = internal.VerifyNotSquashed(version, options.migrationsDir, options.migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	pendingFiles := options.migrationFiles
+	if version > 0 {
+		pendingFiles = options.migrationFiles[version-internal.GetFirstMigrationVersion(options.migrationFiles)+1:]
+	}
+	if len(pendingFiles) == 0 {
+		fmt.Println("- No migrations to apply")
+	}
+
+	for _, file := range pendingFiles {
+		data, err := os.ReadFile(filepath.Join(options.migrationsDir, file))
+		if err != nil {
+			return fmt.Errorf("failed to read migration %q: %w", file, err)
+		}
+
+		fmt.Printf("- Apply migration %q:\n", file)
+		fmt.Println(strings.TrimSuffix(string(data), "\n"))
+
+		if options.insertTestData && (options.resetDatabase || !databaseExists) {
+			var testdataFiles []string
+			testdataFiles, err = internal.FindTestdataFiles(
+				filepath.Join(options.wd, "testdata"),
+				options.testdataSet,
+				int(internal.GetMigrationNumber(file)),
+			)
+			if err != nil {
+				return err
+			}
+			for _, f := range testdataFiles {
+				fmt.Printf("- Insert testdata %q\n", filepath.Base(f))
+			}
+		}
+	}
+
+	if options.resetDatabase || !databaseExists {
+		fmt.Println("- Run hook \"apply-reset-post\"")
+	}
+	fmt.Println("- Record the checksums of the applied migrations")
+	for _, u := range options.config.DatabaseUsers {
+		fmt.Printf("- Grant select permission on schema_migrations and %s to %q\n", internal.ChecksumTable, u)
+	}
+
+	return nil
+}
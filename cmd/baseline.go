@@ -0,0 +1,362 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+var (
+	errMigrationsExist     = errors.New("migrations exist already")
+	errDatabaseMigrated    = errors.New("database is migrated by trek already")
+	errSchemaFilesExist    = errors.New("schema files exist already")
+	errEmptyDatabaseSchema = errors.New("database has no schema")
+)
+
+//nolint:gocognit,cyclop
+func NewBaselineCommand() *cobra.Command {
+	var (
+		connectionFlags postgresConnectionFlags
+		databaseFlags   scratchDatabaseFlags
+	)
+
+	baselineCmd := &cobra.Command{
+		Use:   "baseline",
+		Short: "Adopt a running database by creating the first migration from its schema",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			internal.InitializeFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get working directory: %w", err)
+			}
+
+			config, err := internal.ReadConfig(wd)
+			if err != nil {
+				return fmt.Errorf("failed to read config: %w", err)
+			}
+			databaseFlags.apply(cmd, &config.EmbeddedPostgres)
+
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+			if len(migrationFiles) > 0 {
+				return fmt.Errorf("%w: the baseline has to be the first migration", errMigrationsExist)
+			}
+
+			version, dirty, err := getDatabaseVersion(ctx, &connectionFlags, config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			if version > 0 || dirty {
+				return fmt.Errorf("%w: database is at version %d", errDatabaseMigrated, version)
+			}
+
+			var schemaFile string
+			if !config.UsesPgModeler() {
+				schemaFile, err = baselineSchemaFile(config, wd)
+				if err != nil {
+					return err
+				}
+			}
+
+			databaseConfig, err := connectionFlags.config(config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			liveConn, err := pgx.ConnectConfig(ctx, databaseConfig)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer func() {
+				_ = liveConn.Close(ctx)
+			}()
+
+			tmpDir, err := os.MkdirTemp("", "trek-")
+			if err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+			defer func() {
+				_ = os.RemoveAll(tmpDir)
+			}()
+
+			databases, err := newScratchDatabases(tmpDir, config, databaseFlags.serverDSN, false)
+			if err != nil {
+				return err
+			}
+			defer databases.release(ctx)
+
+			targetConn, err := databases.targetDatabase(ctx, config)
+			if err != nil {
+				return fmt.Errorf("failed to setup target database: %w", err)
+			}
+			defer func() {
+				_ = targetConn.Close(ctx)
+			}()
+
+			up, down, err := generateBaselineStatements(ctx, config, targetConn, liveConn)
+			if err != nil {
+				return err
+			}
+			if up == "" {
+				return errEmptyDatabaseSchema
+			}
+
+			migrations, err := splitBaseline(ctx, config, databases, tmpDir, 1, up, down)
+			if err != nil {
+				return err
+			}
+			baselineFiles, err := writeBaseline(wd, migrationsDir, migrations)
+			if err != nil {
+				return err
+			}
+			baselineVersion := uint(len(baselineFiles))
+
+			if schemaFile != "" {
+				//nolint:gosec
+				err = os.WriteFile(schemaFile, []byte(up), 0o644)
+				if err != nil {
+					return fmt.Errorf("failed to write schema file: %w", err)
+				}
+				log.Printf("Wrote schema file %q\n", schemaFile)
+			} else {
+				log.Printf("Import the database into %s.dbm with pgModeler before generating migrations\n", config.ModelName)
+			}
+
+			// The database runs the baseline already, so it is released
+			_, err = internal.LockMigrations(wd, migrationsDir, baselineFiles)
+			if err != nil {
+				return fmt.Errorf("failed to lock baseline: %w", err)
+			}
+			for _, file := range baselineFiles {
+				log.Printf("Locked checksum of migration %q\n", file)
+			}
+
+			err = writeTemplateFiles(config, baselineVersion)
+			if err != nil {
+				return fmt.Errorf("failed to write template files: %w", err)
+			}
+
+			log.Printf("Marking database %q as migrated to version %d\n", config.DatabaseName, baselineVersion)
+
+			err = markBaselineApplied(ctx, config, migrationsDir, databaseConfig, liveConn, baselineVersion)
+			if err != nil {
+				return err
+			}
+
+			log.Println("Successfully created the baseline")
+
+			return nil
+		},
+	}
+
+	connectionFlags.register(baselineCmd)
+	databaseFlags.register(baselineCmd, clusterTarget, clusterMigrate)
+
+	return baselineCmd
+}
+
+// baselineSchemaFile returns the schema file the baseline is written to, which replaces the one created by init.
+func baselineSchemaFile(config *internal.Config, wd string) (string, error) {
+	schemaDir := config.GetSchemaDir(wd)
+	schemaFile := filepath.Join(schemaDir, "schema.sql")
+
+	err := os.MkdirAll(schemaDir, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create schema directory: %w", err)
+	}
+	files, err := internal.FindSchemaFiles(schemaDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file != schemaFile {
+			return "", fmt.Errorf("%w: %q", errSchemaFilesExist, file)
+		}
+	}
+
+	return schemaFile, nil
+}
+
+// generateBaselineStatements returns the statements which create the schema and privileges of the schema database in
+// the empty database, and the statements which drop them again. The statements are applied to the empty database.
+func generateBaselineStatements(
+	ctx context.Context,
+	config *internal.Config,
+	emptyConn,
+	schemaConn *pgx.Conn,
+) (up, down string, err error) {
+	log.Println("Generating baseline statements")
+
+	// The down statements have to be generated before the up statements are applied to the empty database
+	down, err = internal.DiffSchemas(ctx, config, schemaConn, emptyConn)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to diff schemas for down migration: %w", err)
+	}
+	down = filterMigraStatements(down)
+
+	statements, err := internal.DiffSchemas(ctx, config, emptyConn, schemaConn)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to diff schemas: %w", err)
+	}
+	statements = filterMigraStatements(statements)
+
+	extraStatements, err := generateMissingPermissionStatements(ctx, statements, schemaConn, emptyConn)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate missing permission statements: %w", err)
+	}
+
+	if statements != "" {
+		up += statements + "\n"
+	}
+	if extraStatements != "" {
+		up += "\n-- Statements generated automatically, please review:\n" + extraStatements + "\n"
+	}
+	if down != "" {
+		down += "\n"
+	}
+
+	return up, down, nil
+}
+
+// baselineMigration is one of the migrations a baseline is written to.
+type baselineMigration struct {
+	file string
+	up   string
+	down string
+}
+
+// splitBaseline returns the migrations of the baseline, starting at the version. Like generate, statements which can't
+// run in a transaction are moved into their own migrations, so the rest of the baseline still runs in transactions.
+// The down migrations of a split baseline are generated by applying its migrations to empty databases.
+func splitBaseline(
+	ctx context.Context,
+	config *internal.Config,
+	databases *scratchDatabases,
+	tmpDir string,
+	version uint,
+	up,
+	down string,
+) ([]baselineMigration, error) {
+	segments := internal.SplitMigrationSegments(up)
+	downs := []string{down}
+	if len(segments) > 1 {
+		log.Printf("Splitting the baseline into %d migrations because of non-transactional statements\n", len(segments))
+
+		emptyDir := filepath.Join(tmpDir, "empty")
+		err := os.MkdirAll(emptyDir, 0o755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create empty migrations directory: %w", err)
+		}
+		downs, err = generateSegmentDownStatements(ctx, config, databases, emptyDir, segments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate down migration statements: %w", err)
+		}
+	}
+
+	migrations := make([]baselineMigration, len(segments))
+	for i, segment := range segments {
+		name := internal.BaselineMigrationName
+		if i > 0 {
+			name += "-continued"
+			if segment.NoTransaction {
+				name = internal.BaselineMigrationName + "-no-transaction"
+			}
+		}
+
+		statements := strings.TrimSuffix(segment.SQL, "\n") + "\n"
+		if segment.NoTransaction {
+			statements = internal.NoTransactionDirective + "\n" + statements
+		}
+		segmentDown := downs[i]
+		if requiresNoTransaction(segmentDown) {
+			segmentDown = internal.NoTransactionDirective + "\n" + segmentDown
+		}
+
+		migrations[i] = baselineMigration{
+			file: internal.GetMigrationFileName(version+uint(i), name),
+			up:   statements,
+			down: segmentDown,
+		}
+	}
+
+	return migrations, nil
+}
+
+// writeBaseline writes the migrations of the baseline and returns their files.
+func writeBaseline(wd, migrationsDir string, migrations []baselineMigration) ([]string, error) {
+	files := make([]string, 0, len(migrations))
+	for _, migration := range migrations {
+		err := writeMigrationFiles(wd, filepath.Join(migrationsDir, migration.file), migration.up, migration.down)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, migration.file)
+	}
+
+	return files, nil
+}
+
+// markBaselineApplied sets the version of the database to the last migration of the baseline and records their
+// checksums, without executing the baseline.
+func markBaselineApplied(
+	ctx context.Context,
+	config *internal.Config,
+	migrationsDir string,
+	databaseConfig *pgx.ConnConfig,
+	conn *pgx.Conn,
+	version uint,
+) error {
+	m, closeMigrate, err := internal.NewMigrate(migrationsDir, databaseConfig)
+	if err != nil {
+		return err
+	}
+	defer closeMigrate()
+
+	err = m.Force(int(version))
+	if err != nil {
+		return fmt.Errorf("failed to set database version: %w", err)
+	}
+
+	err = internal.EnsureChecksumTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+	migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+	err = internal.RecordAppliedChecksums(ctx, conn, migrationsDir, migrationFiles, version)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range config.DatabaseUsers {
+		for _, table := range []string{"schema_migrations", internal.ChecksumTable} {
+			_, err = conn.Exec(ctx, fmt.Sprintf("GRANT SELECT ON public.%s TO %q", table, u))
+			if err != nil {
+				return fmt.Errorf("failed to grant select permission on %s to %q: %w", table, u, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -5,25 +5,27 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/fs"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
-	// needed driver.
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/spf13/cobra"
 
 	"github.com/stack11/trek/internal"
 	"github.com/stack11/trek/internal/dbm"
 )
 
+var errLintViolations = errors.New("migrations violate lint rules")
+
 func NewCheckCommand() *cobra.Command {
+	var (
+		databaseFlags scratchDatabaseFlags
+		testdataSet   string
+	)
+
 	checkCmd := &cobra.Command{
 		Use:   "check",
 		Short: "Validate all files",
@@ -42,6 +44,7 @@ func NewCheckCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to read config: %w", err)
 			}
+			databaseFlags.apply(cmd, &config.EmbeddedPostgres)
 
 			migrationsDir, err := internal.GetMigrationsDir(wd)
 			if err != nil {
@@ -52,17 +55,22 @@ func NewCheckCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to create temporary directory: %w", err)
 			}
+			defer func() {
+				_ = os.RemoveAll(tmpDir)
+			}()
 
-			err = checkAll(ctx, config, wd, tmpDir, migrationsDir)
+			databases, err := newScratchDatabases(tmpDir, config, databaseFlags.serverDSN, false)
 			if err != nil {
 				return err
 			}
 
-			//nolint:wrapcheck
-			return os.RemoveAll(tmpDir)
+			return checkAll(ctx, config, wd, databases, migrationsDir, testdataSet)
 		},
 	}
 
+	databaseFlags.register(checkCmd, clusterCheck)
+	checkCmd.Flags().StringVar(&testdataSet, "testdata-set", "", "Only check the testdata of this set instead of all sets")
+
 	return checkCmd
 }
 
@@ -70,36 +78,29 @@ func NewCheckCommand() *cobra.Command {
 func checkAll(
 	ctx context.Context,
 	config *internal.Config,
-	wd,
-	tmpDir,
-	migrationsDir string,
+	wd string,
+	databases *scratchDatabases,
+	migrationsDir,
+	testdataSet string,
 ) error {
-	postgres, conn, dsn, err := setupDatabase(ctx, tmpDir, "check", 5434)
-	defer func() {
-		if conn != nil {
-			_ = conn.Close(ctx)
-		}
-		if postgres != nil {
-			_ = postgres.Stop()
-		}
-	}()
+	defer databases.release(ctx)
+
+	cluster, conn, err := databases.checkDatabase(ctx, config)
 	if err != nil {
 		return fmt.Errorf("failed to setup database: %w", err)
 	}
-	dsn = fmt.Sprintf("%s?sslmode=disable", dsn)
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+	dsn := cluster.databaseDSN(clusterCheck)
 
-	for _, u := range config.DatabaseUsers {
-		var userExists bool
-		userExists, err = internal.CheckUserExists(ctx, conn, u)
-		if err != nil {
-			return fmt.Errorf("failed to check if user exists: %w", err)
-		}
-		if !userExists {
-			_, err = conn.Exec(ctx, fmt.Sprintf("CREATE ROLE %q WITH LOGIN PASSWORD 'postgres'", u))
-			if err != nil {
-				return fmt.Errorf("failed to create user: %w", err)
-			}
-		}
+	serverMajorVersion, err := internal.ServerMajorVersion(conn)
+	if err != nil {
+		return fmt.Errorf("failed to get server version: %w", err)
+	}
+	err = internal.CheckClientVersions(serverMajorVersion)
+	if err != nil {
+		return fmt.Errorf("failed to check PostgreSQL client versions: %w", err)
 	}
 
 	migrationFiles, err := internal.FindMigrations(migrationsDir, true)
@@ -109,12 +110,14 @@ func checkAll(
 
 	hookOptions := &internal.HookOptions{
 		Env: map[string]string{
-			"TREK_POSTGRES_HOST":     "localhost",
-			"TREK_POSTGRES_PORT":     "5434",
-			"TREK_POSTGRES_USER":     "postgres",
-			"TREK_POSTGRES_PASSWORD": "postgres",
-			"TREK_POSTGRES_DATABASE": "postgres",
-			"TREK_POSTGRES_SSLMODE":  "disable",
+			"TREK_POSTGRES_HOST":     conn.Config().Host,
+			"TREK_POSTGRES_PORT":     strconv.Itoa(int(conn.Config().Port)),
+			"TREK_POSTGRES_USER":     conn.Config().User,
+			"TREK_POSTGRES_PASSWORD": conn.Config().Password,
+			"TREK_POSTGRES_DATABASE": conn.Config().Database,
+			"TREK_POSTGRES_SSLMODE":  cluster.sslMode(),
+			// The password of the database users
+			"TREK_POSTGRES_USERS_PASSWORD": cluster.usersPassword,
 		},
 	}
 
@@ -123,32 +126,88 @@ func checkAll(
 		return fmt.Errorf("failed to run hook: %w", err)
 	}
 
-	log.Println("Checking dbm file")
+	if config.UsesPgModeler() {
+		log.Println("Checking dbm file")
 
-	err = checkDBM(config, wd)
-	if err != nil {
-		return fmt.Errorf("failed to check dbm: %w", err)
+		err = checkDBM(config, wd)
+		if err != nil {
+			return fmt.Errorf("failed to check dbm: %w", err)
+		}
 	}
 
 	log.Println("Checking migration file names")
 
-	err = checkMigrationFileNames(migrationFiles)
+	err = checkMigrationFileNames(migrationsDir, migrationFiles)
 	if err != nil {
 		return fmt.Errorf("failed to check migration file names: %w", err)
 	}
 
+	log.Println("Checking migration checksums")
+
+	err = internal.VerifyLockFile(wd, migrationsDir, migrationFiles)
+	if err != nil {
+		return fmt.Errorf("failed to check migration checksums: %w", err)
+	}
+
+	log.Println("Linting migrations")
+
+	err = lintMigrations(config, wd, migrationsDir, migrationFiles)
+	if err != nil {
+		return err
+	}
+
 	log.Println("Checking templates")
 
-	err = checkTemplates(config, uint(len(migrationFiles)))
+	err = checkTemplates(config, internal.GetLatestMigrationVersion(migrationFiles))
 	if err != nil {
 		return fmt.Errorf("failed to check templates: %w", err)
 	}
 
-	log.Println("Checking migrations and testdata")
+	testdataSets := []string{testdataSet}
+	if testdataSet == "" {
+		testdataSets, err = internal.FindTestdataSets(filepath.Join(wd, "testdata"))
+		if err != nil {
+			return fmt.Errorf("failed to find testdata sets: %w", err)
+		}
+		if len(testdataSets) == 0 {
+			testdataSets = []string{""}
+		}
+	}
 
-	err = checkMigrationsAndTestdata(wd, migrationsDir, dsn, migrationFiles)
-	if err != nil {
-		return fmt.Errorf("failed to check migrations and testdata: %w", err)
+	for _, set := range testdataSets {
+		if set == "" {
+			continue
+		}
+		err = internal.VerifyTestdataSet(filepath.Join(wd, "testdata"), set, migrationFiles)
+		if err != nil {
+			return fmt.Errorf("failed to check testdata: %w", err)
+		}
+	}
+
+	for i, set := range testdataSets {
+		if i > 0 {
+			// Every set is checked in a new database, because the rows of the sets may conflict
+			_ = conn.Close(ctx)
+			err = cluster.createDatabase(ctx, clusterCheck, "")
+			if err != nil {
+				return fmt.Errorf("failed to reset database: %w", err)
+			}
+			conn, err = cluster.connect(ctx, clusterCheck)
+			if err != nil {
+				return fmt.Errorf("failed to reset database: %w", err)
+			}
+		}
+
+		if set == "" {
+			log.Println("Checking migrations and testdata")
+		} else {
+			log.Printf("Checking migrations and testdata set %q\n", set)
+		}
+
+		err = checkMigrationsAndTestdata(ctx, wd, migrationsDir, dsn, set, migrationFiles)
+		if err != nil {
+			return fmt.Errorf("failed to check migrations and testdata: %w", err)
+		}
 	}
 
 	for _, u := range config.DatabaseUsers {
@@ -227,14 +286,33 @@ func checkDBM(config *internal.Config, wd string) error {
 	return nil
 }
 
-func checkMigrationFileNames(migrationFiles []string) error {
+func checkMigrationFileNames(migrationsDir string, migrationFiles []string) error {
 	for _, migrationFile := range migrationFiles {
-		if !internal.RegexpMigrationFileName.MatchString(migrationFile) {
+		if !internal.RegexpUpMigrationFileName.MatchString(migrationFile) {
 			//nolint:goerr113
 			return fmt.Errorf("invalid migration file name %q", migrationFile)
 		}
 	}
 
+	// The migrations start at version 1, unless older migrations have been squashed into the first one
+	firstIndex := int(internal.GetFirstMigrationVersion(migrationFiles))
+	if firstIndex > 1 {
+		data, err := os.ReadFile(filepath.Join(migrationsDir, migrationFiles[0]))
+		if err != nil {
+			return fmt.Errorf("failed to read migration %q: %w", migrationFiles[0], err)
+		}
+		// A baseline split into multiple migrations records the version of its last migration
+		if internal.GetSquashedVersion(string(data)) < uint(firstIndex) {
+			//nolint:goerr113
+			return fmt.Errorf(
+				"migration %q doesn't have index 1 and isn't a baseline with the line \"%s %d\"",
+				migrationFiles[0],
+				internal.SquashDirective,
+				firstIndex,
+			)
+		}
+	}
+
 	existingMigrations := map[int]struct{}{}
 	for _, migrationFile := range migrationFiles {
 		index, err := strconv.Atoi(strings.Split(migrationFile, "_")[0])
@@ -248,9 +326,9 @@ func checkMigrationFileNames(migrationFiles []string) error {
 			return fmt.Errorf("migration with index %d exists more than once", index)
 		}
 
-		if len(existingMigrations) != index-1 {
+		if len(existingMigrations) != index-firstIndex {
 			//nolint:goerr113
-			return fmt.Errorf("migration after index %d missing", len(existingMigrations))
+			return fmt.Errorf("migration after index %d missing", firstIndex+len(existingMigrations)-1)
 		}
 
 		existingMigrations[index] = struct{}{}
@@ -285,39 +363,140 @@ func checkTemplates(config *internal.Config, migrationsCount uint) error {
 	return nil
 }
 
-func checkMigrationsAndTestdata(wd, migrationsDir, dsn string, migrationFiles []string) error {
-	m, err := migrate.New(fmt.Sprintf("file://%s", migrationsDir), dsn)
+func checkMigrationsAndTestdata(
+	ctx context.Context,
+	wd,
+	migrationsDir,
+	dsn,
+	testdataSet string,
+	migrationFiles []string,
+) error {
+	m, closeMigrate, err := internal.NewMigrateFromDSN(migrationsDir, dsn)
 	if err != nil {
-		return fmt.Errorf("failed to initialize go-migrate: %w", err)
+		return err
 	}
+	defer closeMigrate()
+
+	for _, file := range migrationFiles {
+		var hasDown bool
+		hasDown, err = internal.HasDownMigration(migrationsDir, file)
+		if err != nil {
+			return fmt.Errorf("failed to check for down migration of %q: %w", file, err)
+		}
+
+		var schemaBefore string
+		if hasDown {
+			schemaBefore, err = dumpSchema(dsn)
+			if err != nil {
+				return err
+			}
+		}
 
-	for index, file := range migrationFiles {
 		err = m.Steps(1)
 		if errors.Is(err, migrate.ErrNoChange) {
 			continue
 		} else if err != nil {
 			return fmt.Errorf("failed to apply migration %q: %w", file, err)
 		}
-		err = filepath.Walk(filepath.Join(wd, "testdata"), func(p string, info fs.FileInfo, err error) error {
-			if strings.HasPrefix(path.Base(p), fmt.Sprintf("%03d", index+1)) {
-				// We have to use psql, because users might use commands like "\copy"
-				// which don't work by directly connecting to the database
-				err := internal.PsqlFile(dsn, p)
-				if err != nil {
-					//nolint:goerr113
-					return fmt.Errorf("failed to apply testdata: %w", err)
-				}
-
-				return nil
+
+		if hasDown {
+			err = checkDownMigration(m, dsn, file, schemaBefore)
+			if err != nil {
+				return err
 			}
+		}
 
-			return nil
-		})
+		testdataFiles, err := internal.FindTestdataFiles(
+			filepath.Join(wd, "testdata"),
+			testdataSet,
+			int(internal.GetMigrationNumber(file)),
+		)
 		if err != nil {
-			//nolint:goerr113
-			return fmt.Errorf("failed to run testdata: %w", err)
+			return err
+		}
+
+		err = internal.InsertTestdata(ctx, dsn, testdataFiles, nil)
+		if err != nil {
+			return fmt.Errorf("failed to apply testdata: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// lintMigrations reports the violations of the lint rules by the up migrations. Released migrations are skipped,
+// because they can't be changed anymore.
+func lintMigrations(config *internal.Config, wd, migrationsDir string, migrationFiles []string) error {
+	locked, err := internal.ReadLockFile(wd)
+	if err != nil {
+		return err
+	}
+
+	errorCount := 0
+	for _, file := range migrationFiles {
+		if _, ok := locked[file]; ok {
+			continue
 		}
+
+		data, err := os.ReadFile(filepath.Join(migrationsDir, file))
+		if err != nil {
+			return fmt.Errorf("failed to read migration %q: %w", file, err)
+		}
+
+		for _, v := range internal.LintMigration(file, string(data), config.Lint.Rules) {
+			log.Println(v.String())
+			if v.Severity == internal.LintSeverityError {
+				errorCount++
+			}
+		}
+	}
+
+	if errorCount > 0 {
+		return fmt.Errorf(
+			"%w: %d errors, fix them or add %q above the statements",
+			errLintViolations,
+			errorCount,
+			internal.LintIgnoreDirective,
+		)
+	}
+
+	return nil
+}
+
+// checkDownMigration rolls back the migration that has just been applied, verifies that the schema is the same as
+// before the migration and applies the migration again.
+func checkDownMigration(m *migrate.Migrate, dsn, file, schemaBefore string) error {
+	err := m.Steps(-1)
+	if err != nil {
+		return fmt.Errorf("failed to apply down migration of %q: %w", file, err)
+	}
+
+	schemaAfter, err := dumpSchema(dsn)
+	if err != nil {
+		return err
+	}
+
+	if schemaBefore != schemaAfter {
+		//nolint:goerr113
+		return fmt.Errorf("down migration of %q does not restore the previous schema", file)
+	}
+
+	err = m.Steps(1)
+	if err != nil {
+		return fmt.Errorf("failed to reapply migration %q: %w", file, err)
 	}
 
 	return nil
 }
+
+func dumpSchema(dsn string) (string, error) {
+	dump, err := internal.PgDump(dsn, []string{
+		"--schema-only",
+		"--exclude-table=public.schema_migrations",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to dump schema: %w", err)
+	}
+
+	return dump, nil
+}
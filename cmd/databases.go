@@ -0,0 +1,610 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+var (
+	errInvalidScratchDSN = errors.New("invalid scratch dsn")
+	errScratchRoleExists = errors.New("role exists on the scratch server already")
+)
+
+// databaseCluster is a PostgreSQL cluster in which the databases to generate and check migrations are created. It is
+// either an embedded cluster started by trek, or an existing server given by DSN. On an existing server the database
+// names are prefixed to be unique, and the databases and roles trek created are dropped again.
+type databaseCluster struct {
+	name string
+	// postgres is nil for an existing server
+	postgres *embeddedpostgres.EmbeddedPostgres
+	// conn is the connection to the maintenance database
+	conn   *pgx.Conn
+	dsn    *url.URL
+	prefix string
+	// databases and users are the ones created by trek
+	databases []string
+	users     []string
+	// owned are the roles created by trek on an existing server, which are shared by all clusters on it
+	owned map[string]struct{}
+	// usersPassword is the password the database users get in the check database
+	usersPassword string
+}
+
+func startEmbeddedCluster(
+	ctx context.Context,
+	tmpDir,
+	name string,
+	port uint32,
+	version embeddedpostgres.PostgresVersion,
+	config internal.EmbeddedPostgresConfig,
+) (*databaseCluster, error) {
+	postgres := internal.NewPostgresDatabase(filepath.Join(tmpDir, name), port, version, config.BinariesPath)
+	err := postgres.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %q database: %w", name, err)
+	}
+
+	c, err := connectCluster(ctx, name, internal.EmbeddedPostgresDSN(port, "postgres", config.UnixSocket), "")
+	if err != nil {
+		_ = postgres.Stop()
+
+		return nil, err
+	}
+	c.postgres = postgres
+
+	return c, nil
+}
+
+func connectCluster(ctx context.Context, name, dsn, prefix string) (*databaseCluster, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return nil, fmt.Errorf("%w: must be a postgres:// URL", errInvalidScratchDSN)
+	}
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %q database: %w", name, err)
+	}
+
+	return &databaseCluster{
+		name:   name,
+		conn:   conn,
+		dsn:    u,
+		prefix: prefix,
+	}, nil
+}
+
+// stop closes the connection and stops the cluster if it is embedded.
+func (c *databaseCluster) stop(ctx context.Context) {
+	_ = c.conn.Close(ctx)
+	if c.postgres != nil {
+		_ = c.postgres.Stop()
+	}
+}
+
+// databaseName returns the actual name of a database of the cluster.
+func (c *databaseCluster) databaseName(database string) string {
+	return c.prefix + database
+}
+
+// databaseDSN returns the DSN of a database of the cluster.
+func (c *databaseCluster) databaseDSN(database string) string {
+	u := *c.dsn
+	u.Path = "/" + c.databaseName(database)
+
+	return u.String()
+}
+
+// sslMode returns the sslmode of the connections to the cluster.
+func (c *databaseCluster) sslMode() string {
+	if sslMode := c.dsn.Query().Get("sslmode"); sslMode != "" {
+		return sslMode
+	}
+
+	return "prefer"
+}
+
+func (c *databaseCluster) databaseExists(ctx context.Context, database string) (bool, error) {
+	//nolint:wrapcheck
+	return internal.CheckDatabaseExists(ctx, c.conn, c.databaseName(database))
+}
+
+// createDatabase drops the database if it exists and creates it again, optionally as copy of template.
+func (c *databaseCluster) createDatabase(ctx context.Context, database, template string) error {
+	name := c.databaseName(database)
+	err := c.dropDatabase(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	statement := fmt.Sprintf("CREATE DATABASE %q", name)
+	if template != "" {
+		statement += fmt.Sprintf(" TEMPLATE %q", c.databaseName(template))
+	}
+	_, err = c.conn.Exec(ctx, statement)
+	if err != nil {
+		return fmt.Errorf("failed to create database %q: %w", name, err)
+	}
+
+	for _, d := range c.databases {
+		if d == name {
+			return nil
+		}
+	}
+	c.databases = append(c.databases, name)
+
+	return nil
+}
+
+// renameDatabase renames a database of the cluster.
+func (c *databaseCluster) renameDatabase(ctx context.Context, database, newDatabase string) error {
+	name, newName := c.databaseName(database), c.databaseName(newDatabase)
+	_, err := c.conn.Exec(ctx, fmt.Sprintf("ALTER DATABASE %q RENAME TO %q", name, newName))
+	if err != nil {
+		return fmt.Errorf("failed to rename database %q: %w", name, err)
+	}
+
+	for i, d := range c.databases {
+		if d == name {
+			c.databases[i] = newName
+		}
+	}
+
+	return nil
+}
+
+// dropDatabase drops the database with the actual name, after terminating the connections to it.
+func (c *databaseCluster) dropDatabase(ctx context.Context, name string) error {
+	_, err := c.conn.Exec(
+		ctx,
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()",
+		name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to terminate connections to database %q: %w", name, err)
+	}
+
+	_, err = c.conn.Exec(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %q", name))
+	if err != nil {
+		return fmt.Errorf("failed to drop database %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// dropDatabases drops the databases created by trek on an existing server.
+func (c *databaseCluster) dropDatabases(ctx context.Context) {
+	if c.postgres != nil {
+		return
+	}
+
+	for _, name := range c.databases {
+		err := c.dropDatabase(ctx, name)
+		if err != nil {
+			log.Printf("Failed to drop database: %v\n", err)
+		}
+	}
+	c.databases = nil
+}
+
+// dropUsers drops the roles created by trek on an existing server, which is only possible once no database has
+// objects or privileges of them anymore.
+func (c *databaseCluster) dropUsers(ctx context.Context) {
+	if c.postgres != nil {
+		return
+	}
+
+	for _, user := range c.users {
+		_, err := c.conn.Exec(ctx, fmt.Sprintf("DROP ROLE IF EXISTS %q", user))
+		if err != nil {
+			log.Printf("Failed to drop role %q: %v\n", user, err)
+		}
+	}
+	c.users = nil
+}
+
+func (c *databaseCluster) connect(ctx context.Context, database string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, c.databaseDSN(database))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %q database: %w", c.databaseName(database), err)
+	}
+
+	return conn, nil
+}
+
+// createUsers creates the users which don't exist yet, and sets the password if it isn't empty. Roles are shared by
+// all databases of the cluster. On an existing server, roles which trek didn't create in this run are refused, because
+// they belong to someone else, e.g. a concurrent run, and would be dropped afterwards.
+func (c *databaseCluster) createUsers(ctx context.Context, users []string, password string) error {
+	for _, user := range users {
+		userExists, err := internal.CheckUserExists(ctx, c.conn, user)
+		if err != nil {
+			return fmt.Errorf("failed to check if user exists: %w", err)
+		}
+		if userExists {
+			if _, ok := c.owned[user]; c.postgres == nil && !ok {
+				return fmt.Errorf("%w: %q, use a server which isn't used by others", errScratchRoleExists, user)
+			}
+			if password != "" {
+				_, err = c.conn.Exec(ctx, fmt.Sprintf("ALTER ROLE %q WITH PASSWORD '%s'", user, password))
+				if err != nil {
+					return fmt.Errorf("failed to set password of user: %w", err)
+				}
+			}
+
+			continue
+		}
+
+		statement := fmt.Sprintf("CREATE ROLE %q WITH LOGIN", user)
+		if password != "" {
+			statement += fmt.Sprintf(" PASSWORD '%s'", password)
+		}
+		_, err = c.conn.Exec(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		c.users = append(c.users, user)
+		if c.owned != nil {
+			c.owned[user] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// scratchDatabases provides the databases used to generate and check migrations, either in embedded clusters or on an
+// existing server. With keepRunning the clusters stay running between runs, and the migrated state of the migrate
+// database is cached in a template database per set of migration files, so that a run only has to copy databases
+// instead of starting clusters and migrating.
+type scratchDatabases struct {
+	tmpDir      string
+	version     embeddedpostgres.PostgresVersion
+	config      internal.EmbeddedPostgresConfig
+	serverDSN   string
+	prefix      string
+	keepRunning bool
+	clusters    map[string]*databaseCluster
+	// owned and usersPassword are passed on to the clusters, see databaseCluster
+	owned         map[string]struct{}
+	usersPassword string
+}
+
+const (
+	clusterTarget  = "target"
+	clusterMigrate = "migrate"
+	clusterCheck   = "check"
+)
+
+// newScratchDatabases returns the databases in embedded clusters, or on the server of serverDSN if it is set.
+func newScratchDatabases(
+	tmpDir string,
+	config *internal.Config,
+	serverDSN string,
+	keepRunning bool,
+) (*scratchDatabases, error) {
+	var prefix string
+	// The embedded clusters only accept local connections, on an existing server the users get a random password
+	usersPassword := "postgres"
+	if serverDSN != "" {
+		b := make([]byte, 20)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate database prefix: %w", err)
+		}
+		prefix = fmt.Sprintf("trek_%s_", hex.EncodeToString(b[:4]))
+		usersPassword = hex.EncodeToString(b[4:])
+	}
+
+	return &scratchDatabases{
+		tmpDir:        tmpDir,
+		version:       config.GetPostgresVersion(),
+		config:        config.EmbeddedPostgres,
+		serverDSN:     serverDSN,
+		prefix:        prefix,
+		keepRunning:   keepRunning,
+		clusters:      map[string]*databaseCluster{},
+		owned:         map[string]struct{}{},
+		usersPassword: usersPassword,
+	}, nil
+}
+
+// port returns the configured port of an embedded cluster, or a free port if none is configured.
+func (d *scratchDatabases) port(name string) (uint32, error) {
+	var port uint32
+	switch name {
+	case clusterTarget:
+		port = d.config.TargetPort
+	case clusterMigrate:
+		port = d.config.MigratePort
+	case clusterCheck:
+		port = d.config.CheckPort
+	}
+	if port != 0 {
+		return port, nil
+	}
+
+	//nolint:wrapcheck
+	return internal.FreePort()
+}
+
+func (d *scratchDatabases) cluster(ctx context.Context, name string) (*databaseCluster, error) {
+	if c, ok := d.clusters[name]; ok {
+		return c, nil
+	}
+
+	var c *databaseCluster
+	if d.serverDSN != "" {
+		var err error
+		c, err = connectCluster(ctx, name, d.serverDSN, d.prefix)
+		if err != nil {
+			return nil, err
+		}
+		c.owned = d.owned
+	} else {
+		port, err := d.port(name)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err = startEmbeddedCluster(ctx, d.tmpDir, name, port, d.version, d.config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.usersPassword = d.usersPassword
+	d.clusters[name] = c
+
+	return c, nil
+}
+
+// release stops the clusters unless they are kept running.
+func (d *scratchDatabases) release(ctx context.Context) {
+	if !d.keepRunning {
+		d.stop(ctx)
+	}
+}
+
+// stop drops what trek created on an existing server and stops all clusters. On an existing server all clusters share
+// the roles, so the roles can only be dropped after the databases of all clusters.
+func (d *scratchDatabases) stop(ctx context.Context) {
+	for _, c := range d.clusters {
+		c.dropDatabases(ctx)
+	}
+	for _, c := range d.clusters {
+		c.dropUsers(ctx)
+	}
+	for name, c := range d.clusters {
+		c.stop(ctx)
+		delete(d.clusters, name)
+	}
+	d.owned = map[string]struct{}{}
+}
+
+// targetDatabase returns a connection to an empty target database with the database users.
+func (d *scratchDatabases) targetDatabase(ctx context.Context, config *internal.Config) (*pgx.Conn, error) {
+	c, err := d.cluster(ctx, clusterTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.createUsers(ctx, config.DatabaseUsers, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.createDatabase(ctx, clusterTarget, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.connect(ctx, clusterTarget)
+}
+
+// migrateDatabase returns a connection to a database with the database users and all migrations applied.
+func (d *scratchDatabases) migrateDatabase(
+	ctx context.Context,
+	config *internal.Config,
+	migrationsDir string,
+) (*pgx.Conn, error) {
+	return d.migrateDatabaseCopy(ctx, config, migrationsDir, clusterMigrate)
+}
+
+// migrateDatabaseCopy is like migrateDatabase for another database of the migrate cluster, so multiple databases with
+// all migrations applied can be used at once.
+func (d *scratchDatabases) migrateDatabaseCopy(
+	ctx context.Context,
+	config *internal.Config,
+	migrationsDir,
+	database string,
+) (*pgx.Conn, error) {
+	c, err := d.cluster(ctx, clusterMigrate)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.createUsers(ctx, config.DatabaseUsers, "")
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashMigrations(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	template := fmt.Sprintf("migrate_%s", hash)
+
+	templateExists, err := c.databaseExists(ctx, template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if template database exists: %w", err)
+	}
+	if templateExists {
+		log.Println("Using cached migrate database")
+	} else {
+		// The migrations are applied to a pending database which only becomes the template once all of them
+		// succeeded, so a failed run can't leave a partially migrated template behind
+		pending := "migrate_pending"
+		err = c.createDatabase(ctx, pending, "")
+		if err != nil {
+			return nil, err
+		}
+
+		migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find migrations: %w", err)
+		}
+		if len(migrationFiles) > 0 {
+			err = executeMigrateSQL(migrationsDir, c.databaseDSN(pending))
+			if err != nil {
+				return nil, fmt.Errorf("failed to execute migrate sql: %w", err)
+			}
+		}
+
+		err = c.renameDatabase(ctx, pending, template)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.createDatabase(ctx, database, template)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.connect(ctx, database)
+}
+
+// checkDatabase returns the cluster and a connection to an empty database with the database users to check the
+// migrations. The users get the password of the cluster, so hooks can connect as them.
+func (d *scratchDatabases) checkDatabase(
+	ctx context.Context,
+	config *internal.Config,
+) (*databaseCluster, *pgx.Conn, error) {
+	c, err := d.cluster(ctx, clusterCheck)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = c.createUsers(ctx, config.DatabaseUsers, c.usersPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = c.createDatabase(ctx, clusterCheck, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := c.connect(ctx, clusterCheck)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, conn, nil
+}
+
+// scratchDatabaseFlags select the server of the scratch databases and override the embedded_postgres settings of
+// the config.
+type scratchDatabaseFlags struct {
+	serverDSN    string
+	ports        map[string]*uint32
+	unixSocket   bool
+	binariesPath string
+}
+
+// register adds a port flag for each of the clusters and the flags shared by all clusters.
+func (f *scratchDatabaseFlags) register(cmd *cobra.Command, clusters ...string) {
+	cmd.Flags().StringVar(&f.serverDSN, "scratch-dsn", "", "DSN of an existing PostgreSQL server to use instead of embedded databases") //nolint:lll
+	f.ports = map[string]*uint32{}
+	for _, name := range clusters {
+		var port uint32
+		f.ports[name] = &port
+		cmd.Flags().Uint32Var(
+			&port,
+			fmt.Sprintf("%s-port", name),
+			0,
+			fmt.Sprintf("Port of the embedded %s database, a free port is picked by default", name),
+		)
+	}
+	cmd.Flags().BoolVar(&f.unixSocket, "unix-socket", false, "Connect to the embedded databases through Unix sockets")
+	cmd.Flags().StringVar(&f.binariesPath, "postgres-binaries", "", "Directory with the extracted PostgreSQL binaries")
+}
+
+// apply sets the flags which have been passed in the config.
+func (f *scratchDatabaseFlags) apply(cmd *cobra.Command, config *internal.EmbeddedPostgresConfig) {
+	for name, port := range f.ports {
+		if !cmd.Flags().Changed(fmt.Sprintf("%s-port", name)) {
+			continue
+		}
+		switch name {
+		case clusterTarget:
+			config.TargetPort = *port
+		case clusterMigrate:
+			config.MigratePort = *port
+		case clusterCheck:
+			config.CheckPort = *port
+		}
+	}
+	if cmd.Flags().Changed("unix-socket") {
+		config.UnixSocket = f.unixSocket
+	}
+	if cmd.Flags().Changed("postgres-binaries") {
+		config.BinariesPath = f.binariesPath
+	}
+}
+
+// hashMigrations returns a hash of the names and contents of all migration files.
+func hashMigrations(migrationsDir string) (string, error) {
+	entries, err := os.ReadDir(migrationsDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	h := sha256.New()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(migrationsDir, entry.Name()))
+		if err != nil {
+			return "", fmt.Errorf("failed to read migration file: %w", err)
+		}
+		_, _ = fmt.Fprintf(h, "%s\n%d\n", entry.Name(), len(data))
+		_, _ = h.Write(data)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+func executeMigrateSQL(migrationsDir, dsn string) error {
+	m, closeMigrate, err := internal.NewMigrateFromDSN(migrationsDir, dsn)
+	if err != nil {
+		return err
+	}
+	defer closeMigrate()
+
+	err = m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to up migrations: %w", err)
+	}
+
+	return nil
+}
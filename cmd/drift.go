@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+var errSchemaDrift = errors.New("schema of the database differs from the migrations")
+
+//nolint:gocognit,cyclop
+func NewDriftCommand() *cobra.Command {
+	var (
+		connectionFlags postgresConnectionFlags
+		databaseFlags   scratchDatabaseFlags
+	)
+
+	driftCmd := &cobra.Command{
+		Use:   "drift",
+		Short: "Compare the schema of a running database with the migrations",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			internal.InitializeFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get working directory: %w", err)
+			}
+
+			config, err := internal.ReadConfig(wd)
+			if err != nil {
+				return fmt.Errorf("failed to read config: %w", err)
+			}
+			databaseFlags.apply(cmd, &config.EmbeddedPostgres)
+
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+
+			version, dirty, err := getDatabaseVersion(ctx, &connectionFlags, config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			if latestVersion := internal.GetLatestMigrationVersion(migrationFiles); dirty || version != latestVersion {
+				log.Printf(
+					"Warning: database is at version %d (dirty: %t) but the latest migration has version %d, "+
+						"the differences include the unapplied migrations\n",
+					version,
+					dirty,
+					latestVersion,
+				)
+			}
+
+			databaseConfig, err := connectionFlags.config(config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			liveConn, err := pgx.ConnectConfig(ctx, databaseConfig)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer func() {
+				_ = liveConn.Close(ctx)
+			}()
+
+			tmpDir, err := os.MkdirTemp("", "trek-")
+			if err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+			defer func() {
+				_ = os.RemoveAll(tmpDir)
+			}()
+
+			databases, err := newScratchDatabases(tmpDir, config, databaseFlags.serverDSN, false)
+			if err != nil {
+				return err
+			}
+			defer databases.release(ctx)
+
+			migrateConn, err := databases.migrateDatabase(ctx, config, migrationsDir)
+			if err != nil {
+				return fmt.Errorf("failed to setup migrate database: %w", err)
+			}
+			defer func() {
+				_ = migrateConn.Close(ctx)
+			}()
+
+			log.Println("Comparing schemas")
+
+			// The statements migrate the running database to the schema defined by the migrations
+			statements, err := internal.DiffSchemas(ctx, config, liveConn, migrateConn)
+			if err != nil {
+				return fmt.Errorf("failed to diff schemas: %w", err)
+			}
+			statements = filterMigraStatements(statements)
+
+			if statements == "" {
+				log.Println("No drift, the database matches the migrations")
+
+				return nil
+			}
+
+			statements, classified := internal.AnnotateStatements(statements)
+			logClassifiedStatements("reconciliation", classified)
+			fmt.Println(statements)
+
+			// Don't print the usage for the expected failure below
+			cmd.SilenceUsage = true
+
+			return errSchemaDrift
+		},
+	}
+
+	connectionFlags.register(driftCmd)
+	databaseFlags.register(driftCmd, clusterMigrate)
+
+	return driftCmd
+}
@@ -6,32 +6,34 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
-	"github.com/golang-migrate/migrate/v4"
 	"github.com/jackc/pgx/v4"
 	"github.com/spf13/cobra"
 
 	"github.com/stack11/trek/internal"
+	"github.com/stack11/trek/internal/differ"
 )
 
 //nolint:gocognit,cyclop
 func NewGenerateCommand() *cobra.Command {
 	var (
-		dev       bool
-		cleanup   bool
-		overwrite bool
-		stdout    bool
-		check     bool
+		dev              bool
+		cleanup          bool
+		overwrite        bool
+		stdout           bool
+		check            bool
+		allowDestructive bool
+		databaseFlags    scratchDatabaseFlags
 	)
 
 	generateCmd := &cobra.Command{
 		Use:   "generate [migration-name]",
-		Short: "Generate the migrations for a pgModeler file",
+		Short: "Generate the migrations for a pgModeler file or plain SQL schema files",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			internal.InitializeFlags(cmd)
 		},
@@ -59,7 +61,10 @@ func NewGenerateCommand() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := context.Background()
+			// Cancelling the context on an interrupt makes running generations fail fast, so their deferred cleanup
+			// stops the embedded databases before we exit
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
 			wd, err := os.Getwd()
 			if err != nil {
@@ -70,6 +75,7 @@ func NewGenerateCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to read config: %w", err)
 			}
+			databaseFlags.apply(cmd, &config.EmbeddedPostgres)
 
 			migrationsDir, err := internal.GetMigrationsDir(wd)
 			if err != nil {
@@ -81,54 +87,45 @@ func NewGenerateCommand() *cobra.Command {
 				return fmt.Errorf("failed to find migrations: %w", err)
 			}
 
+			tmpDir, err := os.MkdirTemp("", "trek-")
+			if err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+			defer func() {
+				_ = os.RemoveAll(tmpDir)
+			}()
+
+			// In dev mode the databases are kept running between regenerations
+			databases, err := newScratchDatabases(tmpDir, config, databaseFlags.serverDSN, dev)
+			if err != nil {
+				return err
+			}
+			defer databases.stop(context.Background())
+
 			var initialFunc, continuousFunc func() error
+			var newMigrationFilePath string
 
 			if stdout {
 				initialFunc = func() error {
-					var tmpDir string
-					tmpDir, err = os.MkdirTemp("", "trek-")
-					if err != nil {
-						return fmt.Errorf("failed to create temporary directory: %w", err)
-					}
-
 					if check {
-						err = checkAll(ctx, config, wd, tmpDir, migrationsDir)
+						err = checkAll(ctx, config, wd, databases, migrationsDir, "")
 						if err != nil {
 							return err
 						}
 					}
 
-					err = runWithStdout(ctx, config, wd, tmpDir, migrationsDir, len(migrationFiles) == 0)
-					if err != nil {
-						return err
-					}
-
-					//nolint:wrapcheck
-					return os.RemoveAll(tmpDir)
+					return runWithStdout(ctx, config, wd, databases, migrationsDir, len(migrationFiles) == 0)
 				}
 
 				continuousFunc = func() error {
-					var tmpDir string
-					tmpDir, err = os.MkdirTemp("", "trek-")
-					if err != nil {
-						return fmt.Errorf("failed to create temporary directory: %w", err)
-					}
-
-					err = runWithStdout(ctx, config, wd, tmpDir, migrationsDir, len(migrationFiles) == 0)
-					if err != nil {
-						return err
-					}
-
-					//nolint:wrapcheck
-					return os.RemoveAll(tmpDir)
+					return runWithStdout(ctx, config, wd, databases, migrationsDir, len(migrationFiles) == 0)
 				}
 			} else {
 				migrationName := args[0]
-				var newMigrationFilePath string
 				var migrationNumber uint
 				newMigrationFilePath, migrationNumber, err = internal.GetNewMigrationFilePath(
 					migrationsDir,
-					uint(len(migrationFiles)),
+					internal.GetLatestMigrationVersion(migrationFiles),
 					migrationName,
 					overwrite,
 				)
@@ -136,32 +133,47 @@ func NewGenerateCommand() *cobra.Command {
 					return fmt.Errorf("failed to get new migration file path: %w", err)
 				}
 
+				// A new migration releases the previous ones, which must not be changed anymore
+				var locked []string
+				locked, err = internal.LockMigrations(
+					wd,
+					migrationsDir,
+					migrationFiles[:migrationNumber-internal.GetFirstMigrationVersion(migrationFiles)],
+				)
+				if err != nil {
+					return fmt.Errorf("failed to lock migrations: %w", err)
+				}
+				for _, file := range locked {
+					log.Printf("Locked checksum of migration %q\n", file)
+				}
+
 				defer func() {
 					if dev && cleanup {
-						if _, err = os.Stat(newMigrationFilePath); err == nil {
-							err = os.Remove(newMigrationFilePath)
-							if err != nil {
-								log.Printf("Failed to delete new migration file: %v\n", err)
-							}
+						err = removeGeneratedMigrationFiles(migrationsDir, migrationNumber)
+						if err != nil {
+							log.Printf("Failed to delete new migration file: %v\n", err)
 						}
 					}
 				}()
 
 				initialFunc = func() error {
-					var tmpDir string
-					tmpDir, err = os.MkdirTemp("", "trek-")
-					if err != nil {
-						return fmt.Errorf("failed to create temporary directory: %w", err)
-					}
-
 					var updated bool
-					updated, err = runWithFile(ctx, config, wd, tmpDir, migrationsDir, newMigrationFilePath, migrationNumber)
+					updated, err = runWithFile(
+						ctx,
+						config,
+						wd,
+						databases,
+						migrationsDir,
+						newMigrationFilePath,
+						migrationNumber,
+						allowDestructive,
+					)
 					if err != nil {
 						return err
 					}
 
 					if updated && check {
-						err = checkAll(ctx, config, wd, tmpDir, migrationsDir)
+						err = checkAll(ctx, config, wd, databases, migrationsDir, "")
 						if err != nil {
 							return err
 						}
@@ -169,8 +181,7 @@ func NewGenerateCommand() *cobra.Command {
 						log.Println("Done checking")
 					}
 
-					//nolint:wrapcheck
-					return os.RemoveAll(tmpDir)
+					return nil
 				}
 				continuousFunc = initialFunc
 			}
@@ -181,13 +192,25 @@ func NewGenerateCommand() *cobra.Command {
 			}
 
 			if dev {
-				for {
-					time.Sleep(time.Millisecond * 100)
-					err = continuousFunc()
-					if err != nil {
-						log.Printf("Failed to run: %v\n", err)
+				var ignored func(p string) bool
+				if !stdout {
+					newMigrationNumber := internal.GetMigrationNumber(filepath.Base(newMigrationFilePath))
+					ignored = func(p string) bool {
+						// Acknowledging a refused migration requires a regeneration
+						if p == newMigrationFilePath && isAcknowledgedRefusedMigration(p) {
+							return false
+						}
+
+						return isGeneratedMigrationFile(migrationsDir, newMigrationNumber, p)
 					}
 				}
+
+				err = watch(ctx, config, wd, migrationsDir, ignored, continuousFunc)
+				if err != nil {
+					return err
+				}
+
+				log.Println("Stopped watching for changes")
 			}
 
 			return nil
@@ -199,41 +222,81 @@ func NewGenerateCommand() *cobra.Command {
 	generateCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Overwrite existing files")
 	generateCmd.Flags().BoolVar(&stdout, "stdout", false, "Output migration statements to stdout")
 	generateCmd.Flags().BoolVar(&check, "check", true, "Run checks after generating the migration")
+	generateCmd.Flags().BoolVar(&allowDestructive, "allow-destructive", false, "Write the migration even if it contains statements which lose data") //nolint:lll
+	databaseFlags.register(generateCmd, clusterTarget, clusterMigrate, clusterCheck)
 
 	return generateCmd
 }
 
-func setupDatabase(
+// watch runs regenerate whenever a file relevant for the migrations changes, until ctx is done.
+func watch(
 	ctx context.Context,
-	tmpDir,
-	name string,
-	port uint32,
-) (
-	*embeddedpostgres.EmbeddedPostgres,
-	*pgx.Conn,
-	string,
-	error,
-) {
-	postgres, dsn := internal.NewPostgresDatabase(filepath.Join(tmpDir, name), port)
-	err := postgres.Start()
-	if err != nil {
-		return nil, nil, "", fmt.Errorf("failed to start %q database: %w", name, err)
+	config *internal.Config,
+	wd,
+	migrationsDir string,
+	ignored func(p string) bool,
+	regenerate func() error,
+) error {
+	modelFile := filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName))
+	schemaDir := config.GetSchemaDir(wd)
+
+	isSchemaSource := func(p string) bool {
+		if config.UsesPgModeler() {
+			return p == modelFile
+		}
+
+		return strings.HasPrefix(p, schemaDir+string(filepath.Separator)) && strings.HasSuffix(p, ".sql")
 	}
 
-	conn, err := pgx.Connect(ctx, dsn)
-	if err != nil {
-		return nil, nil, "", fmt.Errorf("failed to connect to %q database: %w", name, err)
+	dirs := []internal.WatchedDir{
+		{Path: migrationsDir},
+		{Path: filepath.Join(wd, "testdata"), Recursive: true},
+		{Path: filepath.Join(wd, "hooks")},
+	}
+	if config.UsesPgModeler() {
+		dirs = append(dirs, internal.WatchedDir{Path: wd})
+	} else {
+		dirs = append(dirs, internal.WatchedDir{Path: schemaDir, Recursive: true})
 	}
 
-	return postgres, conn, dsn, nil
+	relevant := func(p string) bool {
+		if ignored != nil && ignored(p) {
+			return false
+		}
+		if filepath.Dir(p) == wd {
+			// The exported sql and png files of the model are written next to it
+			return isSchemaSource(p)
+		}
+
+		return true
+	}
+
+	log.Println("Watching for changes, press Ctrl-C to stop")
+
+	//nolint:wrapcheck
+	return internal.Watch(ctx, dirs, 200*time.Millisecond, relevant, func(paths []string) {
+		for _, p := range paths {
+			if !isSchemaSource(p) {
+				// The schema source is compared by content, other changes always require a regeneration
+				modelContent = ""
+
+				break
+			}
+		}
+
+		err := regenerate()
+		if err != nil {
+			log.Printf("Failed to run: %v\n", err)
+		}
+	})
 }
 
 //nolint:gocognit,cyclop
 func runWithStdout(
 	ctx context.Context,
 	config *internal.Config,
-	wd,
-	tmpDir,
+	wd string,
+	databases *scratchDatabases,
 	migrationsDir string,
 	initial bool,
 ) error {
@@ -242,38 +305,28 @@ func runWithStdout(
 		return fmt.Errorf("failed to check if model has been updated: %w", err)
 	}
 	if updated {
-		targetPostgres, targetConn, _, err := setupDatabase(ctx, tmpDir, "target", 5432)
-		defer func() {
-			if targetConn != nil {
-				_ = targetConn.Close(ctx)
-			}
-			if targetPostgres != nil {
-				_ = targetPostgres.Stop()
-			}
-		}()
+		defer databases.release(ctx)
+
+		targetConn, err := databases.targetDatabase(ctx, config)
 		if err != nil {
 			return fmt.Errorf("failed to setup target database: %w", err)
 		}
-
-		migratePostgres, migrateConn, _, err := setupDatabase(ctx, tmpDir, "migrate", 5433)
 		defer func() {
-			if migrateConn != nil {
-				_ = migrateConn.Close(ctx)
-			}
-			if migratePostgres != nil {
-				_ = migratePostgres.Stop()
-			}
+			_ = targetConn.Close(ctx)
 		}()
+
+		migrateConn, err := databases.migrateDatabase(ctx, config, migrationsDir)
 		if err != nil {
 			return fmt.Errorf("failed to setup migrate database: %w", err)
 		}
+		defer func() {
+			_ = migrateConn.Close(ctx)
+		}()
 
-		statements, err := generateMigrationStatements(
+		statements, downStatements, err := generateMigrationStatements(
 			ctx,
 			config,
 			wd,
-			tmpDir,
-			migrationsDir,
 			initial,
 			targetConn,
 			migrateConn,
@@ -282,101 +335,121 @@ func runWithStdout(
 			return fmt.Errorf("failed to generate migration statements: %w", err)
 		}
 
-		file, err := os.CreateTemp("", "migration")
-		if err != nil {
-			return fmt.Errorf("failed get temporary migration file: %w", err)
-		}
-
-		err = os.WriteFile(
-			file.Name(),
-			[]byte(statements),
-			0o600,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to write temporary migration file: %w", err)
-		}
-
-		err = internal.RunHook(wd, "generate-migration-post", &internal.HookOptions{
-			Args: []string{file.Name()},
-		})
-		if err != nil {
-			return fmt.Errorf("failed to run hook: %w", err)
-		}
+		statements, classified := internal.AnnotateStatements(statements)
+		logClassifiedStatements("migration", classified)
+		downStatements, _ = internal.AnnotateStatements(downStatements)
 
-		tmpStatementBytes, err := os.ReadFile(file.Name())
+		statements, err = runGenerateMigrationPostHookOnStatements(wd, statements)
 		if err != nil {
-			return fmt.Errorf("failed to read temporary migration file: %w", err)
+			return err
 		}
-		statements = string(tmpStatementBytes)
 
-		err = os.Remove(file.Name())
+		downStatements, err = runGenerateMigrationPostHookOnStatements(wd, downStatements)
 		if err != nil {
-			return fmt.Errorf("failed to delete temporary migration file: %w", err)
+			return err
 		}
 
 		fmt.Println("")
 		fmt.Println("--")
 		fmt.Println(statements)
+		fmt.Println("-- down")
+		fmt.Println(downStatements)
 		fmt.Println("--")
 	}
 
 	return nil
 }
 
+func logClassifiedStatements(name string, classified []internal.ClassifiedStatement) {
+	for _, c := range classified {
+		log.Printf("Warning: %s line %d is %s, it %s\n", name, c.Line, c.Class, c.Description)
+	}
+}
+
+func runGenerateMigrationPostHookOnStatements(wd, statements string) (string, error) {
+	file, err := os.CreateTemp("", "migration")
+	if err != nil {
+		return "", fmt.Errorf("failed get temporary migration file: %w", err)
+	}
+
+	err = os.WriteFile(
+		file.Name(),
+		[]byte(statements),
+		0o600,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to write temporary migration file: %w", err)
+	}
+
+	err = internal.RunHook(wd, "generate-migration-post", &internal.HookOptions{
+		Args: []string{file.Name()},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to run hook: %w", err)
+	}
+
+	tmpStatementBytes, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read temporary migration file: %w", err)
+	}
+
+	err = os.Remove(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to delete temporary migration file: %w", err)
+	}
+
+	return string(tmpStatementBytes), nil
+}
+
 //nolint:gocognit,cyclop
 func runWithFile(
 	ctx context.Context,
 	config *internal.Config,
-	wd,
-	tmpDir,
+	wd string,
+	databases *scratchDatabases,
 	migrationsDir,
 	newMigrationFilePath string,
 	migrationNumber uint,
+	allowDestructive bool,
 ) (bool, error) {
 	updated, err := checkIfUpdated(config, wd)
 	if err != nil {
 		return false, fmt.Errorf("failed to check if model has been updated: %w", err)
 	}
 	if updated {
-		if _, err = os.Stat(newMigrationFilePath); err == nil {
-			err = os.Remove(newMigrationFilePath)
-			if err != nil {
-				return false, fmt.Errorf("failed to delete generated migration file: %w", err)
-			}
+		// The marker has to be read before the previously generated file is deleted
+		acknowledged, err := internal.HasAllowDestructiveMarker(newMigrationFilePath)
+		if err != nil {
+			return false, fmt.Errorf("failed to check for destructive marker: %w", err)
 		}
 
-		targetPostgres, targetConn, _, err := setupDatabase(ctx, tmpDir, "target", 5432)
-		defer func() {
-			if targetConn != nil {
-				_ = targetConn.Close(ctx)
-			}
-			if targetPostgres != nil {
-				_ = targetPostgres.Stop()
-			}
-		}()
+		err = removeGeneratedMigrationFiles(migrationsDir, migrationNumber)
 		if err != nil {
-			return false, fmt.Errorf("failed to setup target database: %w", err)
+			return false, fmt.Errorf("failed to delete generated migration file: %w", err)
 		}
 
-		migratePostgres, migrateConn, _, err := setupDatabase(ctx, tmpDir, "migrate", 5433)
+		defer databases.release(ctx)
+
+		targetConn, err := databases.targetDatabase(ctx, config)
+		if err != nil {
+			return false, fmt.Errorf("failed to setup target database: %w", err)
+		}
 		defer func() {
-			if migrateConn != nil {
-				_ = migrateConn.Close(ctx)
-			}
-			if migratePostgres != nil {
-				_ = migratePostgres.Stop()
-			}
+			_ = targetConn.Close(ctx)
 		}()
+
+		migrateConn, err := databases.migrateDatabase(ctx, config, migrationsDir)
 		if err != nil {
 			return false, fmt.Errorf("failed to setup migrate database: %w", err)
 		}
+		defer func() {
+			_ = migrateConn.Close(ctx)
+		}()
 
-		statements, err := generateMigrationStatements(
+		statements, downStatements, err := generateMigrationStatements(
 			ctx,
 			config,
 			wd,
-			tmpDir,
-			migrationsDir,
 			migrationNumber == 1,
 			targetConn,
 			migrateConn,
@@ -385,41 +458,288 @@ func runWithFile(
 			return false, fmt.Errorf("failed to generate migration statements: %w", err)
 		}
 
+		// Statements which can't run in a transaction are split into their own migrations
+		segments := internal.SplitMigrationSegments(statements)
+		downs := []string{downStatements}
+		if len(segments) > 1 {
+			log.Printf("Splitting the migration into %d migrations because of non-transactional statements\n", len(segments))
+
+			downs, err = generateSegmentDownStatements(ctx, config, databases, migrationsDir, segments)
+			if err != nil {
+				return false, fmt.Errorf("failed to generate down migration statements: %w", err)
+			}
+		}
+
+		// All migrations are checked before any of them is written, so a refused migration only leaves the file with
+		// the commented out statements behind
+		type migrationFile struct {
+			path       string
+			statements string
+			down       string
+		}
+		files := make([]migrationFile, len(segments))
+		refused := false
+		migrationName := internal.GetMigrationName(filepath.Base(newMigrationFilePath))
+		for i, segment := range segments {
+			path := newMigrationFilePath
+			if i > 0 {
+				name := migrationName + "-continued"
+				if segment.NoTransaction {
+					name = migrationName + "-no-transaction"
+				}
+				path = filepath.Join(migrationsDir, internal.GetMigrationFileName(migrationNumber+uint(i), name))
+			}
+
+			statements, classified := internal.AnnotateStatements(segment.SQL)
+			logClassifiedStatements(filepath.Base(path), classified)
+			if internal.HasDataLoss(classified) {
+				switch {
+				case acknowledged:
+					// The acknowledgement by hand is kept for the next regeneration
+					statements = internal.AllowDestructiveMarker + "\n" + statements
+				case allowDestructive:
+					statements = internal.DestructiveMarker + "\n" + statements
+				default:
+					refused = true
+				}
+			}
+			if segment.NoTransaction {
+				statements = internal.NoTransactionDirective + "\n" + statements
+			}
+
+			down, _ := internal.AnnotateStatements(downs[i])
+			if requiresNoTransaction(down) {
+				down = internal.NoTransactionDirective + "\n" + down
+			}
+
+			files[i] = migrationFile{path: path, statements: statements, down: down}
+		}
+
+		if refused {
+			var all []string
+			for _, segment := range segments {
+				all = append(all, segment.SQL)
+			}
+			err = writeMigrationFiles(
+				wd,
+				newMigrationFilePath,
+				internal.RefusedMigration(strings.Join(all, "\n")),
+				internal.RefusedDownMigration(downStatements),
+			)
+			if err != nil {
+				return false, err
+			}
+
+			//nolint:goerr113
+			return false, fmt.Errorf(
+				"the migration contains statements which lose data, pass --allow-destructive or add %q to %q",
+				internal.AllowDestructiveMarker,
+				filepath.Base(newMigrationFilePath),
+			)
+		}
+
+		for _, f := range files {
+			err = writeMigrationFiles(wd, f.path, f.statements, f.down)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		err = writeTemplateFiles(config, migrationNumber+uint(len(segments)-1))
+		if err != nil {
+			return false, fmt.Errorf("failed to write template files: %w", err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// writeMigrationFiles writes the up migration and its down migration.
+func writeMigrationFiles(wd, path, statements, downStatements string) error {
+	downPath := filepath.Join(filepath.Dir(path), internal.GetDownMigrationFileName(filepath.Base(path)))
+
+	for _, f := range []struct {
+		path    string
+		content string
+	}{
+		{path: path, content: statements},
+		{path: downPath, content: downStatements},
+	} {
 		//nolint:gosec
-		err = os.WriteFile(
-			newMigrationFilePath,
-			[]byte(statements),
+		err := os.WriteFile(
+			f.path,
+			[]byte(f.content),
 			0o644,
 		)
 		if err != nil {
-			return false, fmt.Errorf("failed to write migration file: %w", err)
+			return fmt.Errorf("failed to write migration file: %w", err)
 		}
-		log.Println("Wrote migration file")
+		log.Printf("Wrote migration file %q\n", filepath.Base(f.path))
 
 		err = internal.RunHook(wd, "generate-migration-post", &internal.HookOptions{
-			Args: []string{newMigrationFilePath},
+			Args: []string{f.path},
 		})
 		if err != nil {
-			return false, fmt.Errorf("failed to run hook: %w", err)
+			return fmt.Errorf("failed to run hook: %w", err)
 		}
+	}
+
+	return nil
+}
+
+func requiresNoTransaction(sql string) bool {
+	for _, s := range internal.SplitStatements(sql) {
+		if internal.RequiresNoTransaction(s.SQL) {
+			return true
+		}
+	}
+
+	return false
+}
 
-		err = writeTemplateFiles(config, migrationNumber)
+// generateSegmentDownStatements returns the down statements of every segment of a split migration. The segments are
+// applied one by one to two copies of the migrate database, one of them a segment ahead, which are compared after
+// every segment.
+func generateSegmentDownStatements(
+	ctx context.Context,
+	config *internal.Config,
+	databases *scratchDatabases,
+	migrationsDir string,
+	segments []internal.MigrationSegment,
+) ([]string, error) {
+	beforeConn, err := databases.migrateDatabaseCopy(ctx, config, migrationsDir, "migrate_before")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = beforeConn.Close(ctx)
+	}()
+
+	afterConn, err := databases.migrateDatabaseCopy(ctx, config, migrationsDir, "migrate_after")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = afterConn.Close(ctx)
+	}()
+
+	downs := make([]string, len(segments))
+	for i, segment := range segments {
+		err = executeMigrationSegment(ctx, afterConn, segment)
 		if err != nil {
-			return false, fmt.Errorf("failed to write template files: %w", err)
+			return nil, err
 		}
 
-		return true, nil
+		down, err := internal.DiffSchemas(ctx, config, afterConn, beforeConn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff schemas: %w", err)
+		}
+		down = filterMigraStatements(down)
+		if down != "" {
+			down += "\n"
+		}
+		downs[i] = down
+
+		err = executeMigrationSegment(ctx, beforeConn, segment)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return false, nil
+	return downs, nil
+}
+
+// executeMigrationStatements executes the statements like apply executes them once generate split them into
+// migrations.
+func executeMigrationStatements(ctx context.Context, conn *pgx.Conn, statements string) error {
+	for _, segment := range internal.SplitMigrationSegments(statements) {
+		err := executeMigrationSegment(ctx, conn, segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func executeMigrationSegment(ctx context.Context, conn *pgx.Conn, segment internal.MigrationSegment) error {
+	for _, statements := range migrationSegmentExecs(segment) {
+		_, err := conn.Exec(ctx, statements)
+		if err != nil {
+			return fmt.Errorf("failed to execute migration statements: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// migrationSegmentExecs returns the SQL of every Exec which executes the segment. A segment which can't run in a
+// transaction is executed statement by statement, the others at once, which runs them in an implicit transaction.
+func migrationSegmentExecs(segment internal.MigrationSegment) []string {
+	if !segment.NoTransaction {
+		return []string{segment.SQL}
+	}
+
+	var execs []string
+	for _, s := range internal.SplitStatements(segment.SQL) {
+		execs = append(execs, s.SQL)
+	}
+
+	return execs
+}
+
+// isGeneratedMigrationFile returns whether the path is a migration file written by generate for the migration with
+// the number, which may have been split into multiple migrations with higher numbers.
+func isGeneratedMigrationFile(migrationsDir string, migrationNumber uint, path string) bool {
+	if filepath.Dir(path) != migrationsDir {
+		return false
+	}
+	number := internal.GetMigrationNumber(filepath.Base(path))
+
+	return number != 0 && number >= migrationNumber
+}
+
+// isAcknowledgedRefusedMigration returns whether the AllowDestructiveMarker has been added to the migration file
+// written by generate for a refused migration.
+func isAcknowledgedRefusedMigration(file string) bool {
+	acknowledged, err := internal.HasAllowDestructiveMarker(file)
+	if err != nil || !acknowledged {
+		return false
+	}
+	data, err := os.ReadFile(file)
+
+	return err == nil && internal.IsRefusedMigration(string(data))
+}
+
+// removeGeneratedMigrationFiles removes the migration files written by generate for the migration with the number.
+func removeGeneratedMigrationFiles(migrationsDir string, migrationNumber uint) error {
+	entries, err := os.ReadDir(migrationsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(migrationsDir, entry.Name())
+		if entry.IsDir() || !isGeneratedMigrationFile(migrationsDir, migrationNumber, path) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("failed to delete %q: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
 }
 
 func checkIfUpdated(config *internal.Config, wd string) (bool, error) {
-	m, err := os.ReadFile(filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName)))
+	m, err := internal.ReadSchemaSource(config, wd)
 	if err != nil {
-		return false, fmt.Errorf("failed to read model file: %w", err)
+		return false, fmt.Errorf("failed to read schema source: %w", err)
 	}
-	mStr := strings.TrimSuffix(string(m), "\n")
+	mStr := strings.TrimSuffix(m, "\n")
 	if mStr == "" || mStr == modelContent {
 		return false, nil
 	}
@@ -457,142 +777,122 @@ var (
 	modelContent = ""
 )
 
+// generateMigrationStatements returns the statements of the up migration and the down migration.
+//
 //nolint:cyclop
 func generateMigrationStatements(
 	ctx context.Context,
 	config *internal.Config,
-	wd,
-	tmpDir,
-	migrationsDir string,
+	wd string,
 	initial bool,
 	targetConn,
 	migrateConn *pgx.Conn,
-) (string, error) {
+) (up, down string, err error) {
 	log.Println("Generating migration statements")
 
-	err := internal.PgModelerExportToFile(
-		filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName)),
-		filepath.Join(wd, fmt.Sprintf("%s.sql", config.ModelName)),
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to export model: %w", err)
-	}
-
-	go func() {
-		err = internal.PgModelerExportToPng(
+	if config.UsesPgModeler() {
+		err = internal.PgModelerExportToFile(
 			filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName)),
-			filepath.Join(wd, fmt.Sprintf("%s.png", config.ModelName)),
+			filepath.Join(wd, fmt.Sprintf("%s.sql", config.ModelName)),
 		)
 		if err != nil {
-			log.Printf("Failed to export png: %v\n", err)
+			return "", "", fmt.Errorf("failed to export model: %w", err)
 		}
-	}()
 
-	err = internal.CreateUsers(ctx, migrateConn, config.DatabaseUsers)
-	if err != nil {
-		return "", fmt.Errorf("failed to create migrate users: %w", err)
+		go func() {
+			err := internal.PgModelerExportToPng(
+				filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName)),
+				filepath.Join(wd, fmt.Sprintf("%s.png", config.ModelName)),
+			)
+			if err != nil {
+				log.Printf("Failed to export png: %v\n", err)
+			}
+		}()
 	}
 
-	err = internal.CreateUsers(ctx, targetConn, config.DatabaseUsers)
+	err = executeTargetSQL(ctx, config, wd, targetConn)
 	if err != nil {
-		return "", fmt.Errorf("failed to create target users: %w", err)
+		return "", "", fmt.Errorf("failed to execute target sql: %w", err)
 	}
 
-	err = executeTargetSQL(ctx, config, wd, targetConn)
+	// The down statements have to be generated before the up statements are applied to the migrate database
+	down, err = internal.DiffSchemas(ctx, config, targetConn, migrateConn)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute target sql: %w", err)
+		return "", "", fmt.Errorf("failed to diff schemas for down migration: %w", err)
+	}
+	down = filterMigraStatements(down)
+	if down != "" {
+		down += "\n"
 	}
 
 	if initial {
 		// If we are developing the schema initially, there will be no diffs,
 		// and we want to copy over the schema file to the initial migration file
-		var input []byte
-		input, err = os.ReadFile(filepath.Join(wd, fmt.Sprintf("%s.sql", config.ModelName)))
+		var input string
+		input, err = internal.ReadSchemaSQL(config, wd)
 		if err != nil {
-			return "", fmt.Errorf("failed to read sql file: %w", err)
+			return "", "", fmt.Errorf("failed to read schema sql: %w", err)
 		}
 
-		return string(input), nil
-	}
-
-	err = executeMigrateSQL(migrationsDir, migrateConn)
-	if err != nil {
-		return "", fmt.Errorf("failed to execute migrate sql: %w", err)
+		return input, down, nil
 	}
 
-	statements, err := internal.Migra(internal.DSN(migrateConn, "disable"), internal.DSN(targetConn, "disable"))
+	statements, err := internal.DiffSchemas(ctx, config, migrateConn, targetConn)
 	if err != nil {
-		return "", fmt.Errorf("failed to run migra: %w", err)
-	}
-
-	// Filter stuff from go-migrate that doesn't exist in the target db, and we don't have and need anyway
-	statements = strings.ReplaceAll(
-		statements,
-		"alter table \"public\".\"schema_migrations\" drop constraint \"schema_migrations_pkey\";",
-		"",
-	)
-	statements = strings.ReplaceAll(
-		statements,
-		"drop index if exists \"public\".\"schema_migrations_pkey\";",
-		"",
-	)
-	statements = strings.ReplaceAll(
-		statements,
-		"drop table \"public\".\"schema_migrations\";",
-		"",
-	)
-	statements = strings.Trim(statements, "\n")
-
-	var lines []string
-	for _, line := range strings.Split(statements, "\n") {
-		if line != "" {
-			lines = append(lines, line)
-		}
+		return "", "", fmt.Errorf("failed to diff schemas: %w", err)
 	}
-	statements = strings.Join(lines, "\n")
+	statements = filterMigraStatements(statements)
 
-	extraStatements, err := generateMissingPermissionStatements(ctx, tmpDir, statements, targetConn, migrateConn)
+	extraStatements, err := generateMissingPermissionStatements(ctx, statements, targetConn, migrateConn)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate missing permission statements: %w", err)
+		return "", "", fmt.Errorf("failed to generate missing permission statements: %w", err)
 	}
 
-	var output string
 	if statements != "" {
-		output += statements
+		up += statements
 	}
 	if statements != "" && extraStatements != "" {
-		output += "\n\n"
+		up += "\n\n"
 	}
 	if extraStatements != "" {
-		output += "-- Statements generated automatically, please review:\n" + extraStatements
+		up += "-- Statements generated automatically, please review:\n" + extraStatements
 	}
-	if output != "" {
-		output += "\n"
+	if up != "" {
+		up += "\n"
 	}
 
-	return output, nil
+	return up, down, nil
 }
 
-func executeMigrateSQL(migrationsDir string, migrateConn *pgx.Conn) error {
-	m, err := migrate.New(fmt.Sprintf("file://%s", migrationsDir), internal.DSN(migrateConn, "disable"))
-	if err != nil {
-		return fmt.Errorf("failed to create migrate: %w", err)
-	}
-	err = m.Up()
-	if err != nil {
-		return fmt.Errorf("failed to up migrations: %w", err)
+// filterMigraStatements removes the statements of the go-migrate schema_migrations table, which doesn't exist in the
+// target database and which we don't need anyway, and removes empty lines.
+func filterMigraStatements(statements string) string {
+	var lines []string
+	for _, statement := range strings.Split(statements, "\n\n") {
+		// The tables of go-migrate and trek only exist in databases which have been migrated by apply
+		if strings.Contains(statement, "\"public\".\"schema_migrations\"") ||
+			strings.Contains(statement, "\"public\".\"schema_migrations_pkey\"") ||
+			strings.Contains(statement, "\"public\".\"trek_migrations\"") ||
+			strings.Contains(statement, "\"public\".\"trek_migrations_pkey\"") {
+			continue
+		}
+		for _, line := range strings.Split(statement, "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
 	}
 
-	return nil
+	return strings.Join(lines, "\n")
 }
 
 func executeTargetSQL(ctx context.Context, config *internal.Config, wd string, targetConn *pgx.Conn) error {
-	targetSQL, err := os.ReadFile(filepath.Join(wd, fmt.Sprintf("%s.sql", config.ModelName)))
+	targetSQL, err := internal.ReadSchemaSQL(config, wd)
 	if err != nil {
 		return fmt.Errorf("failed to read target sql: %w", err)
 	}
 
-	_, err = targetConn.Exec(ctx, string(targetSQL))
+	_, err = targetConn.Exec(ctx, targetSQL)
 	if err != nil {
 		return fmt.Errorf("failed to execute target sql: %w", err)
 	}
@@ -600,72 +900,23 @@ func executeTargetSQL(ctx context.Context, config *internal.Config, wd string, t
 	return nil
 }
 
+// generateMissingPermissionStatements applies the statements to the migrate database and compares the ownership,
+// privileges and default privileges of both databases in the catalog, to find the changes the differ missed.
 func generateMissingPermissionStatements(
 	ctx context.Context,
-	tmpDir,
 	statements string,
 	targetConn,
 	migrateConn *pgx.Conn,
 ) (string, error) {
-	_, err := migrateConn.Exec(ctx, statements)
+	err := executeMigrationStatements(ctx, migrateConn, statements)
 	if err != nil {
 		return "", fmt.Errorf("failed to apply generated migration: %w", err)
 	}
 
-	pgDumpOptions := []string{
-		"--schema-only",
-		"--exclude-table=public.schema_migrations",
-	}
-
-	targetDump, err := internal.PgDump(internal.DSN(targetConn, "disable"), pgDumpOptions)
+	permissionStatements, err := differ.DiffPrivileges(ctx, migrateConn, targetConn)
 	if err != nil {
-		//nolint:wrapcheck
-		return "", err
-	}
-
-	migrateDump, err := internal.PgDump(internal.DSN(migrateConn, "disable"), pgDumpOptions)
-	if err != nil {
-		//nolint:wrapcheck
-		return "", err
-	}
-
-	targetDumpFile := filepath.Join(tmpDir, "target.sql")
-	err = os.WriteFile(targetDumpFile, []byte(targetDump), 0o600)
-	if err != nil {
-		return "", fmt.Errorf("failed to write target.sql file: %w", err)
-	}
-
-	migrateDumpFile := filepath.Join(tmpDir, "migrate.sql")
-	err = os.WriteFile(migrateDumpFile, []byte(migrateDump), 0o600)
-	if err != nil {
-		return "", fmt.Errorf("failed to write migrate.sql file: %w", err)
-	}
-
-	diffCmd := exec.Command(
-		"diff",
-		"--minimal",
-		"--unchanged-line-format=",
-		"--old-line-format=",
-		"--new-line-format=%L",
-		migrateDumpFile,
-		targetDumpFile,
-	)
-	diffCmd.Stderr = os.Stderr
-
-	output, err := diffCmd.Output()
-	if err != nil {
-		var ee *exec.ExitError
-		if !(errors.As(err, &ee) && ee.ExitCode() != 0) {
-			return "", fmt.Errorf("failed to run diff: %w %s", err, string(output))
-		}
-	}
-
-	var lines []string
-	for _, line := range strings.Split(string(output), "\n") {
-		if strings.HasPrefix(line, "ALTER ") {
-			lines = append(lines, line)
-		}
+		return "", fmt.Errorf("failed to compare privileges: %w", err)
 	}
 
-	return strings.Join(lines, "\n"), nil
+	return permissionStatements, nil
 }
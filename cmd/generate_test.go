@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestMigrationSegmentExecs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		statements string
+		want       []string
+	}{
+		{
+			name:       "transactional statements",
+			statements: "CREATE TABLE t (a int);\nCREATE INDEX t_a ON t (a);",
+			want:       []string{"CREATE TABLE t (a int);\nCREATE INDEX t_a ON t (a);"},
+		},
+		{
+			name: "create index concurrently",
+			statements: "CREATE TABLE t (a int, b int);\n" +
+				"CREATE INDEX CONCURRENTLY t_a ON t (a);\nCREATE INDEX CONCURRENTLY t_b ON t (b);\n" +
+				"ALTER TABLE t ADD COLUMN c int;\nALTER TABLE t ADD COLUMN d int;",
+			want: []string{
+				"CREATE TABLE t (a int, b int);",
+				"CREATE INDEX CONCURRENTLY t_a ON t (a);",
+				"CREATE INDEX CONCURRENTLY t_b ON t (b);",
+				"ALTER TABLE t ADD COLUMN c int;\nALTER TABLE t ADD COLUMN d int;",
+			},
+		},
+		{
+			name: "enum value used after adding it",
+			statements: "ALTER TYPE status ADD VALUE 'archived';\n" +
+				"ALTER TABLE items ALTER COLUMN status SET DEFAULT 'archived';",
+			want: []string{
+				"ALTER TYPE status ADD VALUE 'archived';",
+				"ALTER TABLE items ALTER COLUMN status SET DEFAULT 'archived';",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got []string
+			for _, segment := range internal.SplitMigrationSegments(tt.statements) {
+				got = append(got, migrationSegmentExecs(segment)...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("migrationSegmentExecs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGenerateMissingPermissionStatements applies a generated migration with statements which can't run in a
+// transaction to the databases of the server of TREK_TEST_SCRATCH_DSN, which needs the privileges of --scratch-dsn.
+func TestGenerateMissingPermissionStatements(t *testing.T) {
+	t.Parallel()
+
+	dsn := os.Getenv("TREK_TEST_SCRATCH_DSN")
+	if dsn == "" {
+		t.Skip("TREK_TEST_SCRATCH_DSN is not set")
+	}
+
+	ctx := context.Background()
+	config := &internal.Config{}
+	databases, err := newScratchDatabases(t.TempDir(), config, dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer databases.release(ctx)
+
+	targetConn, err := databases.targetDatabase(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = targetConn.Close(ctx)
+	}()
+	migrateConn, err := databases.migrateDatabase(ctx, config, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = migrateConn.Close(ctx)
+	}()
+
+	statements := "CREATE TABLE public.items (id integer, name text);\n" +
+		"CREATE INDEX CONCURRENTLY items_name ON public.items USING btree (name);\n" +
+		"CREATE TYPE public.status AS ENUM ('active');\n" +
+		"ALTER TYPE public.status ADD VALUE 'archived';\n" +
+		"ALTER TABLE public.items ADD COLUMN status public.status DEFAULT 'archived'::public.status;\n"
+	_, err = generateMissingPermissionStatements(ctx, statements, targetConn, migrateConn)
+	if err != nil {
+		t.Fatalf("generateMissingPermissionStatements() error = %v", err)
+	}
+
+	var index string
+	err = migrateConn.QueryRow(ctx, "SELECT indexname FROM pg_indexes WHERE tablename = 'items'").Scan(&index)
+	if err != nil || index != "items_name" {
+		t.Errorf("index = %q, %v, want %q", index, err, "items_name")
+	}
+}
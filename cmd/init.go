@@ -19,6 +19,7 @@ import (
 var errInvalidModelName = errors.New("invalid model name")
 var errInvalidDatabaseName = errors.New("invalid database name")
 var errInvalidDatabaseUsersList = errors.New("invalid database users list")
+var errInvalidSchemaSource = errors.New("invalid schema source")
 
 //nolint:gocognit,cyclop
 func NewInitCommand() *cobra.Command {
@@ -27,6 +28,7 @@ func NewInitCommand() *cobra.Command {
 		modelName     string
 		databaseName  string
 		databaseUsers string
+		schemaSource  string
 	)
 	initCmd := &cobra.Command{
 		Use:   "init",
@@ -53,11 +55,20 @@ func NewInitCommand() *cobra.Command {
 				}
 			}
 
-			if modelName == "" || databaseName == "" || databaseUsers == "" {
+			if schemaSource != internal.SchemaSourcePgModeler && schemaSource != internal.SchemaSourceSQL {
+				return fmt.Errorf("%w %q", errInvalidSchemaSource, schemaSource)
+			}
+			usePgModeler := schemaSource == internal.SchemaSourcePgModeler
+
+			if (usePgModeler && modelName == "") || databaseName == "" || databaseUsers == "" {
 				fmt.Printf("The following answers can only contain a-z and _\n")
 			}
 
-			if modelName != "" {
+			if !usePgModeler {
+				if modelName != "" {
+					return fmt.Errorf("%w: a model name can only be used with pgmodeler", errInvalidModelName)
+				}
+			} else if modelName != "" {
 				if err = validateModelName(modelName); err != nil {
 					return fmt.Errorf("invalid model name %q: %w", modelName, err)
 				}
@@ -103,18 +114,29 @@ func NewInitCommand() *cobra.Command {
 			}
 
 			templateData := map[string]interface{}{
-				"trek_version": version,
-				"model_name":   modelName,
-				"db_name":      databaseName,
-				"db_users":     strings.Split(databaseUsers, ","),
+				"trek_version":  version,
+				"model_name":    modelName,
+				"db_name":       databaseName,
+				"db_users":      strings.Split(databaseUsers, ","),
+				"schema_source": schemaSource,
 			}
 
-			for file, tmpl := range map[string]string{
-				fmt.Sprintf("%s.dbm", modelName): embed.DbmTmpl,
-				"docker-compose.yaml":            embed.DockerComposeYamlTmpl,
-				"Dockerfile":                     embed.DockerfileTmpl,
-				"trek.yaml":                      embed.TrekYamlTmpl,
-			} {
+			templateFiles := map[string]string{
+				"docker-compose.yaml": embed.DockerComposeYamlTmpl,
+				"Dockerfile":          embed.DockerfileTmpl,
+				"trek.yaml":           embed.TrekYamlTmpl,
+			}
+			if usePgModeler {
+				templateFiles[fmt.Sprintf("%s.dbm", modelName)] = embed.DbmTmpl
+			} else {
+				err = os.MkdirAll("schema", 0o755)
+				if err != nil {
+					return fmt.Errorf("failed to create directory %q: %w", "schema", err)
+				}
+				templateFiles[filepath.Join("schema", "schema.sql")] = embed.SchemaSQLTmpl
+			}
+
+			for file, tmpl := range templateFiles {
 				err = writeTemplateFile(tmpl, file, templateData)
 				if err != nil {
 					return fmt.Errorf("failed to write %q: %w", file, err)
@@ -137,6 +159,8 @@ func NewInitCommand() *cobra.Command {
 				"apply-reset-pre":         {},
 				"apply-reset-post":        {},
 				"generate-migration-post": {"echo \"Running on migration file $1\""},
+				"rollback-pre":            {},
+				"rollback-post":           {},
 			} {
 				err = writeSampleHook(wd, name, args...)
 				if err != nil {
@@ -161,7 +185,21 @@ func NewInitCommand() *cobra.Command {
 				return fmt.Errorf("failed to create temporary directory: %w", err)
 			}
 
-			_, err = runWithFile(ctx, config, wd, tmpDir, migrationsDir, filepath.Join(migrationsDir, "001_init.up.sql"), 1)
+			databases, err := newScratchDatabases(tmpDir, config, "", false)
+			if err != nil {
+				return err
+			}
+
+			_, err = runWithFile(
+				ctx,
+				config,
+				wd,
+				databases,
+				migrationsDir,
+				filepath.Join(migrationsDir, "001_init.up.sql"),
+				1,
+				false,
+			)
 			if err != nil {
 				return fmt.Errorf("failed to generate first migration: %w", err)
 			}
@@ -175,6 +213,7 @@ func NewInitCommand() *cobra.Command {
 	initCmd.Flags().StringVar(&modelName, "model-name", "", "Model (file) name")
 	initCmd.Flags().StringVar(&databaseName, "database-name", "", "Database name")
 	initCmd.Flags().StringVar(&databaseUsers, "database-users", "", "Database users")
+	initCmd.Flags().StringVar(&schemaSource, "schema-source", internal.SchemaSourcePgModeler, "Source of the target schema, either pgmodeler or sql") //nolint:lll
 
 	return initCmd
 }
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+//nolint:gocognit,cyclop
+func NewRollbackCommand() *cobra.Command {
+	var (
+		connectionFlags postgresConnectionFlags
+		steps           uint
+		toVersion       uint
+	)
+
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll back migrations of a running database using the down migrations",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			internal.InitializeFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get working directory: %w", err)
+			}
+
+			config, err := internal.ReadConfig(wd)
+			if err != nil {
+				return fmt.Errorf("failed to read config: %w", err)
+			}
+
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+
+			databaseConfig, err := connectionFlags.config(config.DatabaseName)
+			if err != nil {
+				return err
+			}
+			m, closeMigrate, err := internal.NewMigrate(migrationsDir, databaseConfig)
+			if err != nil {
+				return err
+			}
+			defer closeMigrate()
+
+			currentVersion, dirty, err := m.Version()
+			if errors.Is(err, migrate.ErrNilVersion) {
+				log.Println("No migrations applied, nothing to roll back")
+
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("failed to get current version: %w", err)
+			}
+			if dirty {
+				//nolint:goerr113
+				return fmt.Errorf("database is dirty at version %d", currentVersion)
+			}
+			firstVersion := internal.GetFirstMigrationVersion(migrationFiles)
+			latestVersion := internal.GetLatestMigrationVersion(migrationFiles)
+			if currentVersion > latestVersion {
+				//nolint:goerr113
+				return fmt.Errorf("database is at version %d but migration files only exist up to version %d",
+					currentVersion,
+					latestVersion,
+				)
+			}
+			err = internal.VerifyNotSquashed(currentVersion, migrationsDir, migrationFiles)
+			if err != nil {
+				return err
+			}
+			squashedVersion, err := internal.GetSquashedMigrationVersion(migrationsDir, migrationFiles)
+			if err != nil {
+				return err
+			}
+
+			var targetVersion uint
+			if cmd.Flags().Changed("to") {
+				if toVersion > currentVersion {
+					//nolint:goerr113
+					return fmt.Errorf(
+						"database is at version %d which is older than version %d, use the apply command instead",
+						currentVersion,
+						toVersion,
+					)
+				}
+				targetVersion = toVersion
+			} else {
+				if steps > currentVersion {
+					//nolint:goerr113
+					return fmt.Errorf("can not roll back %d steps, database is at version %d", steps, currentVersion)
+				}
+				targetVersion = currentVersion - steps
+			}
+
+			if targetVersion > 0 && targetVersion < squashedVersion {
+				//nolint:goerr113
+				return fmt.Errorf(
+					"can not roll back to version %d, the migrations up to version %d have been squashed into %q",
+					targetVersion,
+					squashedVersion,
+					migrationFiles[0],
+				)
+			}
+
+			if targetVersion == currentVersion {
+				log.Println("No changes!")
+
+				return nil
+			}
+
+			for version := currentVersion; version > targetVersion && version >= firstVersion; version-- {
+				file := migrationFiles[version-firstVersion]
+				var hasDown bool
+				hasDown, err = internal.HasDownMigration(migrationsDir, file)
+				if err != nil {
+					return fmt.Errorf("failed to check for down migration of %q: %w", file, err)
+				}
+				if !hasDown {
+					//nolint:goerr113
+					return fmt.Errorf("migration %q has no down migration", file)
+				}
+			}
+
+			databaseConn, err := pgx.ConnectConfig(ctx, databaseConfig)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database: %w", err)
+			}
+			defer func() {
+				_ = databaseConn.Close(ctx)
+			}()
+
+			err = internal.EnsureChecksumTable(ctx, databaseConn)
+			if err != nil {
+				return err
+			}
+
+			err = internal.RunHook(wd, "rollback-pre", nil)
+			if err != nil {
+				return fmt.Errorf("failed to run hook: %w", err)
+			}
+
+			for version := currentVersion; version > targetVersion && version >= firstVersion; version-- {
+				file := migrationFiles[version-firstVersion]
+				log.Printf("Rolling back migration %q\n", file)
+				err = m.Steps(-1)
+				if err != nil {
+					return fmt.Errorf("failed to roll back migration %q: %w", file, err)
+				}
+
+				// The migration may be changed before it is applied again. Rolling back a baseline also rolls back the
+				// migrations squashed into it.
+				previousVersion := version - 1
+				if version == firstVersion {
+					previousVersion = 0
+				}
+				err = internal.DeleteAppliedChecksums(ctx, databaseConn, previousVersion)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = internal.RunHook(wd, "rollback-post", nil)
+			if err != nil {
+				return fmt.Errorf("failed to run hook: %w", err)
+			}
+
+			log.Printf("Successfully rolled back database to version %d\n", targetVersion)
+
+			return nil
+		},
+	}
+
+	connectionFlags.register(rollbackCmd)
+	rollbackCmd.Flags().UintVar(&steps, "steps", 1, "Number of migrations to roll back")
+	rollbackCmd.Flags().UintVar(&toVersion, "to", 0, "Roll back all migrations newer than this version")
+
+	return rollbackCmd
+}
@@ -9,9 +9,14 @@ func NewRootCommand() *cobra.Command {
 	}
 
 	rootCmd.AddCommand(NewApplyCommand())
+	rootCmd.AddCommand(NewBaselineCommand())
 	rootCmd.AddCommand(NewCheckCommand())
+	rootCmd.AddCommand(NewDriftCommand())
 	rootCmd.AddCommand(NewGenerateCommand())
 	rootCmd.AddCommand(NewInitCommand())
+	rootCmd.AddCommand(NewRollbackCommand())
+	rootCmd.AddCommand(NewSquashCommand())
+	rootCmd.AddCommand(NewStatusCommand())
 
 	return rootCmd
 }
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+var errInvalidSquashVersion = errors.New("invalid squash version")
+
+//nolint:gocognit,cyclop
+func NewSquashCommand() *cobra.Command {
+	var (
+		databaseFlags scratchDatabaseFlags
+		upTo          uint
+	)
+
+	squashCmd := &cobra.Command{
+		Use:   "squash",
+		Short: "Squash the migrations up to a version into a single baseline migration",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			internal.InitializeFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get working directory: %w", err)
+			}
+
+			config, err := internal.ReadConfig(wd)
+			if err != nil {
+				return fmt.Errorf("failed to read config: %w", err)
+			}
+			databaseFlags.apply(cmd, &config.EmbeddedPostgres)
+
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+
+			firstVersion := internal.GetFirstMigrationVersion(migrationFiles)
+			latestVersion := internal.GetLatestMigrationVersion(migrationFiles)
+			if upTo <= firstVersion || upTo > latestVersion {
+				return fmt.Errorf(
+					"%w: --up-to must be between %d and %d",
+					errInvalidSquashVersion,
+					firstVersion+1,
+					latestVersion,
+				)
+			}
+
+			// Changed migrations would be squashed into a baseline which differs from the databases using them
+			err = internal.VerifyLockFile(wd, migrationsDir, migrationFiles)
+			if err != nil {
+				return fmt.Errorf("failed to check migration checksums: %w", err)
+			}
+
+			squashedFiles := migrationFiles[:upTo-firstVersion+1]
+
+			tmpDir, err := os.MkdirTemp("", "trek-")
+			if err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+			defer func() {
+				_ = os.RemoveAll(tmpDir)
+			}()
+
+			squashedDir := filepath.Join(tmpDir, "migrations")
+			err = copySquashedMigrations(migrationsDir, squashedDir, squashedFiles)
+			if err != nil {
+				return err
+			}
+
+			databases, err := newScratchDatabases(tmpDir, config, databaseFlags.serverDSN, false)
+			if err != nil {
+				return err
+			}
+			defer databases.release(ctx)
+
+			log.Printf("Applying the migrations up to version %d\n", upTo)
+
+			migrateConn, err := databases.migrateDatabase(ctx, config, squashedDir)
+			if err != nil {
+				return fmt.Errorf("failed to setup migrate database: %w", err)
+			}
+			defer func() {
+				_ = migrateConn.Close(ctx)
+			}()
+
+			targetConn, err := databases.targetDatabase(ctx, config)
+			if err != nil {
+				return fmt.Errorf("failed to setup target database: %w", err)
+			}
+			defer func() {
+				_ = targetConn.Close(ctx)
+			}()
+
+			statements, down, err := generateBaselineStatements(ctx, config, targetConn, migrateConn)
+			if err != nil {
+				return err
+			}
+			// The baseline ends at the version, so a split baseline starts at an older one. Its first migration
+			// records the version, which keeps databases between them from being migrated
+			segments := uint(len(internal.SplitMigrationSegments(statements)))
+			if segments > upTo-firstVersion+1 {
+				return fmt.Errorf(
+					"%w: the baseline needs %d migrations because of non-transactional statements, squash more migrations",
+					errInvalidSquashVersion,
+					segments,
+				)
+			}
+			migrations, err := splitBaseline(ctx, config, databases, tmpDir, upTo-segments+1, statements, down)
+			if err != nil {
+				return err
+			}
+			migrations[0].up = fmt.Sprintf("%s %d\n%s", internal.SquashDirective, upTo, migrations[0].up)
+
+			for _, file := range squashedFiles {
+				for _, f := range []string{file, internal.GetDownMigrationFileName(file)} {
+					err = os.Remove(filepath.Join(migrationsDir, f))
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						return fmt.Errorf("failed to delete %q: %w", f, err)
+					}
+				}
+				log.Printf("Deleted squashed migration %q\n", file)
+			}
+
+			baselineFiles, err := writeBaseline(wd, migrationsDir, migrations)
+			if err != nil {
+				return err
+			}
+
+			// A baseline of released migrations is released as well
+			unlocked, err := internal.UnlockMigrations(wd, squashedFiles)
+			if err != nil {
+				return fmt.Errorf("failed to unlock squashed migrations: %w", err)
+			}
+			if unlocked {
+				_, err = internal.LockMigrations(wd, migrationsDir, baselineFiles)
+				if err != nil {
+					return fmt.Errorf("failed to lock baseline: %w", err)
+				}
+				for _, file := range baselineFiles {
+					log.Printf("Locked checksum of migration %q\n", file)
+				}
+			}
+
+			renamed, err := internal.SquashTestdata(filepath.Join(wd, "testdata"), upTo)
+			if err != nil {
+				return err
+			}
+			for _, file := range renamed {
+				log.Printf("Renamed testdata to %q\n", file)
+			}
+
+			log.Printf("Successfully squashed %d migrations into %q\n", len(squashedFiles), baselineFiles[0])
+
+			return nil
+		},
+	}
+
+	squashCmd.Flags().UintVar(&upTo, "up-to", 0, "Squash the migrations up to and including this version")
+	internal.MarkFlagRequired(squashCmd, "up-to")
+	databaseFlags.register(squashCmd, clusterTarget, clusterMigrate)
+
+	return squashCmd
+}
+
+// copySquashedMigrations copies the up and down migration files to dir.
+func copySquashedMigrations(migrationsDir, dir string, files []string) error {
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations directory: %w", err)
+	}
+
+	for _, file := range files {
+		for _, f := range []string{file, internal.GetDownMigrationFileName(file)} {
+			data, err := os.ReadFile(filepath.Join(migrationsDir, f))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to read migration %q: %w", f, err)
+			}
+			//nolint:gosec
+			err = os.WriteFile(filepath.Join(dir, f), data, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to copy migration %q: %w", f, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+
+	"github.com/stack11/trek/internal"
+)
+
+var (
+	errPendingMigrations = errors.New("pending migrations")
+	errDirtyDatabase     = errors.New("database is dirty")
+	errInvalidOutput     = errors.New("invalid output format")
+)
+
+const (
+	migrationStatusApplied = "applied"
+	migrationStatusPending = "pending"
+	migrationStatusDirty   = "dirty"
+	migrationStatusUnknown = "unknown"
+)
+
+type migrationStatus struct {
+	Version uint   `json:"version"`
+	File    string `json:"file"`
+	Status  string `json:"status"`
+}
+
+type databaseStatus struct {
+	Version    uint              `json:"version"`
+	Dirty      bool              `json:"dirty"`
+	Migrations []migrationStatus `json:"migrations"`
+}
+
+//nolint:gocognit,cyclop
+func NewStatusCommand() *cobra.Command {
+	var (
+		connectionFlags postgresConnectionFlags
+		output          string
+	)
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the applied and pending migrations of a running database",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			internal.InitializeFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+
+			if output != "table" && output != "json" {
+				return fmt.Errorf("%w %q, use table or json", errInvalidOutput, output)
+			}
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get working directory: %w", err)
+			}
+
+			config, err := internal.ReadConfig(wd)
+			if err != nil {
+				return fmt.Errorf("failed to read config: %w", err)
+			}
+
+			migrationsDir, err := internal.GetMigrationsDir(wd)
+			if err != nil {
+				return fmt.Errorf("failed to get migrations directory: %w", err)
+			}
+
+			migrationFiles, err := internal.FindMigrations(migrationsDir, true)
+			if err != nil {
+				return fmt.Errorf("failed to read migrations: %w", err)
+			}
+
+			version, dirty, err := getDatabaseVersion(ctx, &connectionFlags, config.DatabaseName)
+			if err != nil {
+				return err
+			}
+
+			status := databaseStatus{
+				Version:    version,
+				Dirty:      dirty,
+				Migrations: []migrationStatus{},
+			}
+			pending := false
+			for _, file := range migrationFiles {
+				s := migrationStatus{
+					Version: internal.GetMigrationNumber(file),
+					File:    file,
+					Status:  migrationStatusPending,
+				}
+				if s.Version < version || (s.Version == version && !dirty) {
+					s.Status = migrationStatusApplied
+				} else if s.Version == version {
+					s.Status = migrationStatusDirty
+				} else {
+					pending = true
+				}
+				status.Migrations = append(status.Migrations, s)
+			}
+			for v := internal.GetLatestMigrationVersion(migrationFiles) + 1; v <= version; v++ {
+				status.Migrations = append(status.Migrations, migrationStatus{
+					Version: v,
+					Status:  migrationStatusUnknown,
+				})
+			}
+
+			if output == "json" {
+				var data []byte
+				data, err = json.MarshalIndent(status, "", "  ")
+				if err != nil {
+					return fmt.Errorf("failed to encode status: %w", err)
+				}
+				fmt.Println(string(data))
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				_, _ = fmt.Fprintln(w, "VERSION\tFILE\tSTATUS")
+				for _, s := range status.Migrations {
+					_, _ = fmt.Fprintf(w, "%03d\t%s\t%s\n", s.Version, s.File, s.Status)
+				}
+				err = w.Flush()
+				if err != nil {
+					return fmt.Errorf("failed to write status: %w", err)
+				}
+			}
+
+			// Don't print the usage for the expected failures below
+			cmd.SilenceUsage = true
+
+			if dirty {
+				return fmt.Errorf("%w at version %d", errDirtyDatabase, version)
+			}
+			if pending {
+				return errPendingMigrations
+			}
+
+			return nil
+		},
+	}
+
+	connectionFlags.register(statusCmd)
+	statusCmd.Flags().StringVar(&output, "output", "table", "Output format, either table or json")
+
+	return statusCmd
+}
+
+// getDatabaseVersion reads the version from the go-migrate table without creating the database or the table.
+func getDatabaseVersion(
+	ctx context.Context,
+	connectionFlags *postgresConnectionFlags,
+	databaseName string,
+) (version uint, dirty bool, err error) {
+	maintenanceConfig, err := connectionFlags.config("postgres")
+	if err != nil {
+		return 0, false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, maintenanceConfig)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	databaseExists, err := internal.CheckDatabaseExists(ctx, conn, databaseName)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to check if database exists: %w", err)
+	}
+	if !databaseExists {
+		return 0, false, nil
+	}
+
+	databaseConfig, err := connectionFlags.config(databaseName)
+	if err != nil {
+		return 0, false, err
+	}
+	dbConn, err := pgx.ConnectConfig(ctx, databaseConfig)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		_ = dbConn.Close(ctx)
+	}()
+
+	tableExists, err := internal.CheckTableExists(ctx, dbConn, "public", "schema_migrations")
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to check if schema_migrations table exists: %w", err)
+	}
+	if !tableExists {
+		return 0, false, nil
+	}
+
+	var v int64
+	err = dbConn.QueryRow(ctx, "SELECT version, dirty FROM public.schema_migrations LIMIT 1").Scan(&v, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	// go-migrate stores -1 when all migrations have been rolled back
+	if v < 0 {
+		return 0, dirty, nil
+	}
+
+	return uint(v), dirty, nil
+}
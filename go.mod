@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/fergusstrange/embedded-postgres v1.17.0
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/jackc/pgx/v4 v4.16.1
 	github.com/manifoldco/promptui v0.9.0
@@ -15,7 +16,6 @@ require (
 
 require (
 	github.com/chzyer/readline v1.5.0 // indirect
-	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
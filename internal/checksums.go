@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// LockFileName is the name of the file recording the checksums of the released migrations.
+	LockFileName = "trek.lock"
+	// ChecksumTable is the table in which apply records the checksums of the applied migrations.
+	ChecksumTable = "trek_migrations"
+
+	checksumPrefix = "sha256:"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	errInvalidLockFile  = errors.New("invalid lock file")
+)
+
+// MigrationChecksum returns the checksum of the migration file.
+func MigrationChecksum(migrationsDir, file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(migrationsDir, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to read migration: %w", err)
+	}
+	sum := sha256.Sum256(data)
+
+	return checksumPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+// ReadLockFile returns the checksums of the lock file by the names of the migration files.
+func ReadLockFile(wd string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(wd, LockFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], checksumPrefix) {
+			return nil, fmt.Errorf("%w: line %d must contain a file name and a checksum", errInvalidLockFile, line)
+		}
+		checksums[fields[0]] = fields[1]
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", scanner.Err())
+	}
+
+	return checksums, nil
+}
+
+// WriteLockFile writes the checksums to the lock file, ordered by the names of the migration files.
+func WriteLockFile(wd string, checksums map[string]string) error {
+	files := make([]string, 0, len(checksums))
+	for file := range checksums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var b strings.Builder
+	b.WriteString("# Checksums of the released migrations, which must not be changed anymore. Generated by trek.\n")
+	for _, file := range files {
+		b.WriteString(fmt.Sprintf("%s %s\n", file, checksums[file]))
+	}
+
+	//nolint:gosec
+	err := os.WriteFile(filepath.Join(wd, LockFileName), []byte(b.String()), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	return nil
+}
+
+// withDownMigrations returns the up migration files together with the names of their down migration files.
+func withDownMigrations(files []string) []string {
+	all := make([]string, 0, 2*len(files))
+	for _, file := range files {
+		all = append(all, file, GetDownMigrationFileName(file))
+	}
+
+	return all
+}
+
+// LockMigrations adds the up migration files and their down migration files which aren't in the lock file yet to it.
+// The checksums of files which are already locked aren't changed. It returns the newly locked files.
+func LockMigrations(wd, migrationsDir string, files []string) ([]string, error) {
+	checksums, err := ReadLockFile(wd)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked []string
+	for _, file := range withDownMigrations(files) {
+		if _, ok := checksums[file]; ok {
+			continue
+		}
+		checksum, err := MigrationChecksum(migrationsDir, file)
+		if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(file, migrationFileSuffixDown) {
+			// Migrations don't need a down migration
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		checksums[file] = checksum
+		locked = append(locked, file)
+	}
+	if len(locked) == 0 {
+		return nil, nil
+	}
+
+	return locked, WriteLockFile(wd, checksums)
+}
+
+// UnlockMigrations removes the up migration files and their down migration files from the lock file, e.g. after they
+// have been squashed. It returns whether any of them was locked.
+func UnlockMigrations(wd string, files []string) (bool, error) {
+	checksums, err := ReadLockFile(wd)
+	if err != nil {
+		return false, err
+	}
+
+	unlocked := false
+	for _, file := range withDownMigrations(files) {
+		if _, ok := checksums[file]; ok {
+			delete(checksums, file)
+			unlocked = true
+		}
+	}
+	if !unlocked {
+		return false, nil
+	}
+
+	return true, WriteLockFile(wd, checksums)
+}
+
+// VerifyLockFile returns an error if a locked up or down migration file has been changed or removed. files are the up
+// migration files.
+func VerifyLockFile(wd, migrationsDir string, files []string) error {
+	checksums, err := ReadLockFile(wd)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]struct{}{}
+	for _, file := range withDownMigrations(files) {
+		existing[file] = struct{}{}
+	}
+
+	var problems []string
+	for file, checksum := range checksums {
+		if _, ok := existing[file]; !ok {
+			problems = append(problems, fmt.Sprintf("%q has been removed", file))
+
+			continue
+		}
+		actual, err := MigrationChecksum(migrationsDir, file)
+		if errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, fmt.Sprintf("%q has been removed", file))
+
+			continue
+		} else if err != nil {
+			return err
+		}
+		if actual != checksum {
+			problems = append(problems, fmt.Sprintf("%q has been changed", file))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+
+		return fmt.Errorf("%w: released migration %s", ErrChecksumMismatch, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// EnsureChecksumTable creates the table of the applied checksums if it doesn't exist.
+func EnsureChecksumTable(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS public.%s (
+			version bigint NOT NULL PRIMARY KEY,
+			file text NOT NULL,
+			checksum text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+		ChecksumTable,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create checksum table: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyAppliedChecksums returns an error if the recorded checksum of an applied migration differs from its file.
+// files are the up migration files. The checksums of migrations which have been squashed into a baseline since they
+// were applied aren't verified.
+func VerifyAppliedChecksums(ctx context.Context, conn *pgx.Conn, migrationsDir string, files []string) error {
+	rows, err := conn.Query(ctx, fmt.Sprintf("SELECT version, file, checksum FROM public.%s ORDER BY version", ChecksumTable))
+	if err != nil {
+		return fmt.Errorf("failed to query checksums: %w", err)
+	}
+	defer rows.Close()
+
+	first := GetFirstMigrationVersion(files)
+
+	var problems []string
+	for rows.Next() {
+		var (
+			version        int64
+			file, checksum string
+		)
+		err = rows.Scan(&version, &file, &checksum)
+		if err != nil {
+			return fmt.Errorf("failed to scan checksum: %w", err)
+		}
+		if version < int64(first) || version >= int64(first)+int64(len(files)) {
+			continue
+		}
+		current := files[version-int64(first)]
+		if first > 1 && version == int64(first) && file != current {
+			// The migration has been squashed into the baseline with its version
+			continue
+		}
+		actual, err := MigrationChecksum(migrationsDir, current)
+		if err != nil {
+			return err
+		}
+		if actual != checksum {
+			problems = append(problems, fmt.Sprintf("%q (applied as %q)", current, file))
+		}
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("failed to query checksums: %w", rows.Err())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf(
+			"%w: migration %s differs from the applied migration",
+			ErrChecksumMismatch,
+			strings.Join(problems, ", "),
+		)
+	}
+
+	return nil
+}
+
+// RecordAppliedChecksums records the checksums of the migrations up to and including version, which aren't recorded
+// yet.
+func RecordAppliedChecksums(
+	ctx context.Context,
+	conn *pgx.Conn,
+	migrationsDir string,
+	files []string,
+	version uint,
+) error {
+	for _, file := range files {
+		if GetMigrationNumber(file) > version {
+			break
+		}
+		checksum, err := MigrationChecksum(migrationsDir, file)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Exec(
+			ctx,
+			fmt.Sprintf(
+				"INSERT INTO public.%s (version, file, checksum) VALUES ($1, $2, $3) ON CONFLICT (version) DO NOTHING",
+				ChecksumTable,
+			),
+			GetMigrationNumber(file),
+			file,
+			checksum,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record checksum: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteAppliedChecksums deletes the checksums of the migrations newer than version, e.g. after a rollback.
+func DeleteAppliedChecksums(ctx context.Context, conn *pgx.Conn, version uint) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf("DELETE FROM public.%s WHERE version > $1", ChecksumTable), int64(version))
+	if err != nil {
+		return fmt.Errorf("failed to delete checksums: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package internal_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestLockMigrations(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		change func(migrationsDir string) error
+		want   bool
+	}{
+		{
+			name:   "unchanged",
+			change: func(string) error { return nil },
+			want:   false,
+		},
+		{
+			name: "up migration changed",
+			change: func(migrationsDir string) error {
+				return os.WriteFile(filepath.Join(migrationsDir, "001_init.up.sql"), []byte("SELECT 2;\n"), 0o600)
+			},
+			want: true,
+		},
+		{
+			name: "down migration changed",
+			change: func(migrationsDir string) error {
+				return os.WriteFile(filepath.Join(migrationsDir, "001_init.down.sql"), []byte("SELECT 2;\n"), 0o600)
+			},
+			want: true,
+		},
+		{
+			name: "down migration removed",
+			change: func(migrationsDir string) error {
+				return os.Remove(filepath.Join(migrationsDir, "001_init.down.sql"))
+			},
+			want: true,
+		},
+		{
+			name: "down migration added to a migration without one",
+			change: func(migrationsDir string) error {
+				return os.WriteFile(filepath.Join(migrationsDir, "002_users.down.sql"), []byte("SELECT 2;\n"), 0o600)
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			wd := t.TempDir()
+			migrationsDir := filepath.Join(wd, "migrations")
+			files := []string{"001_init.up.sql", "002_users.up.sql"}
+			err := os.Mkdir(migrationsDir, 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []string{"001_init.up.sql", "001_init.down.sql", "002_users.up.sql"} {
+				err = os.WriteFile(filepath.Join(migrationsDir, f), []byte("SELECT 1;\n"), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			locked, err := internal.LockMigrations(wd, migrationsDir, files)
+			if err != nil {
+				t.Fatalf("LockMigrations() error = %v", err)
+			}
+			want := []string{"001_init.up.sql", "001_init.down.sql", "002_users.up.sql"}
+			if !reflect.DeepEqual(locked, want) {
+				t.Errorf("LockMigrations() = %v, want %v", locked, want)
+			}
+
+			err = tt.change(migrationsDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = internal.VerifyLockFile(wd, migrationsDir, files)
+			if got := errors.Is(err, internal.ErrChecksumMismatch); got != tt.want {
+				t.Errorf("VerifyLockFile() error = %v, want a checksum mismatch: %v", err, tt.want)
+			}
+
+			unlocked, err := internal.UnlockMigrations(wd, files[:1])
+			if err != nil || !unlocked {
+				t.Fatalf("UnlockMigrations() = %v, %v", unlocked, err)
+			}
+			checksums, err := internal.ReadLockFile(wd)
+			if err != nil {
+				t.Fatalf("ReadLockFile() error = %v", err)
+			}
+			if _, ok := checksums["001_init.down.sql"]; ok {
+				t.Errorf("UnlockMigrations() kept the down migration in the lock file")
+			}
+		})
+	}
+}
@@ -16,6 +16,11 @@ var regexpValidIdentifier = regexp.MustCompile(regexpStringValidIdentifier)
 
 var ErrInvalidValuesInConfig = errors.New("invalid values in config")
 
+const (
+	DifferMigra  = "migra"
+	DifferNative = "native"
+)
+
 type Config struct {
 	//nolint:tagliatelle
 	ModelName string `yaml:"model_name"`
@@ -24,6 +29,43 @@ type Config struct {
 	//nolint:tagliatelle
 	DatabaseUsers []string   `yaml:"db_users"`
 	Templates     []Template `yaml:"templates"`
+	// Differ selects the tool used to compare schemas, either migra (default) or native.
+	Differ string `yaml:"differ"`
+	// SchemaSource selects how the target schema is defined, either by a pgModeler model (default) or by the plain
+	// SQL files in SchemaDir.
+	//nolint:tagliatelle
+	SchemaSource string `yaml:"schema_source"`
+	//nolint:tagliatelle
+	SchemaDir string `yaml:"schema_dir"`
+	// PostgresVersion is the version of the embedded databases, either a major version or a full version.
+	//nolint:tagliatelle
+	PostgresVersion string `yaml:"postgres_version"`
+	//nolint:tagliatelle
+	EmbeddedPostgres EmbeddedPostgresConfig `yaml:"embedded_postgres"`
+	Lint             LintConfig             `yaml:"lint"`
+}
+
+// LintConfig configures the lint rules checked for the migrations.
+type LintConfig struct {
+	// Rules sets the severity of rules by their id, either error, warning (default) or off.
+	Rules map[string]LintSeverity `yaml:"rules"`
+}
+
+// EmbeddedPostgresConfig configures the embedded databases used by generate and check.
+type EmbeddedPostgresConfig struct {
+	// The ports of the embedded databases, a free port is picked for every port which is 0.
+	//nolint:tagliatelle
+	TargetPort uint32 `yaml:"target_port"`
+	//nolint:tagliatelle
+	MigratePort uint32 `yaml:"migrate_port"`
+	//nolint:tagliatelle
+	CheckPort uint32 `yaml:"check_port"`
+	// UnixSocket connects to the embedded databases through their Unix socket instead of TCP.
+	//nolint:tagliatelle
+	UnixSocket bool `yaml:"unix_socket"`
+	// BinariesPath is a directory with the extracted PostgreSQL binaries, so they don't have to be downloaded.
+	//nolint:tagliatelle
+	BinariesPath string `yaml:"binaries_path"`
 }
 
 type Template struct {
@@ -55,7 +97,7 @@ func ReadConfig(wd string) (*Config, error) {
 }
 
 func (c *Config) validate() (problems []string) {
-	if !ValidateIdentifier(c.ModelName) {
+	if (c.UsesPgModeler() || c.ModelName != "") && !ValidateIdentifier(c.ModelName) {
 		p := fmt.Sprintf("Model name %q contains invalid characters. Must match %q.",
 			c.ModelName,
 			regexpStringValidIdentifier,
@@ -79,6 +121,57 @@ func (c *Config) validate() (problems []string) {
 		}
 	}
 
+	if c.SchemaSource != "" && c.SchemaSource != SchemaSourcePgModeler && c.SchemaSource != SchemaSourceSQL {
+		p := fmt.Sprintf("Schema source %q is invalid. Must be %q or %q.",
+			c.SchemaSource,
+			SchemaSourcePgModeler,
+			SchemaSourceSQL,
+		)
+		problems = append(problems, p)
+	}
+	if c.Differ != "" && c.Differ != DifferMigra && c.Differ != DifferNative {
+		p := fmt.Sprintf("Differ %q is invalid. Must be %q or %q.", c.Differ, DifferMigra, DifferNative)
+		problems = append(problems, p)
+	}
+
+	if c.PostgresVersion != "" && !ValidatePostgresVersion(c.PostgresVersion) {
+		p := fmt.Sprintf("PostgreSQL version %q is invalid. Must be a major version from 10 to 14 or a full version like \"14.3.0\".", //nolint:lll
+			c.PostgresVersion,
+		)
+		problems = append(problems, p)
+	}
+
+	for rule, severity := range c.Lint.Rules {
+		if !IsLintRule(rule) {
+			problems = append(problems, fmt.Sprintf("Lint rule %q does not exist.", rule))
+		}
+		if severity != LintSeverityError && severity != LintSeverityWarning && severity != LintSeverityOff {
+			p := fmt.Sprintf("Severity %q of lint rule %q is invalid. Must be %q, %q or %q.",
+				severity,
+				rule,
+				LintSeverityError,
+				LintSeverityWarning,
+				LintSeverityOff,
+			)
+			problems = append(problems, p)
+		}
+	}
+
+	ports := map[uint32]struct{}{}
+	for _, port := range []uint32{
+		c.EmbeddedPostgres.TargetPort,
+		c.EmbeddedPostgres.MigratePort,
+		c.EmbeddedPostgres.CheckPort,
+	} {
+		if port == 0 {
+			continue
+		}
+		if _, ok := ports[port]; ok {
+			problems = append(problems, fmt.Sprintf("Port %d is used for multiple embedded databases.", port))
+		}
+		ports[port] = struct{}{}
+	}
+
 	return problems
 }
 
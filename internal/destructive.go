@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ChangeClass describes the impact a statement has when it is applied to a database with data.
+type ChangeClass string
+
+const (
+	ChangeClassSafe         ChangeClass = "safe"
+	ChangeClassLockHeavy    ChangeClass = "lock-heavy"
+	ChangeClassTableRewrite ChangeClass = "table-rewrite"
+	ChangeClassDataLoss     ChangeClass = "data-loss"
+)
+
+// AllowDestructiveMarker acknowledges the data loss of a migration when it is added to the migration file by hand.
+const AllowDestructiveMarker = "-- trek:allow-destructive"
+
+// DestructiveMarker marks a migration which loses data and was written because of --allow-destructive. Unlike the
+// AllowDestructiveMarker it doesn't acknowledge the data loss of later regenerations.
+const DestructiveMarker = "-- trek:destructive"
+
+const warningPrefix = "-- trek:warning "
+
+type changeRule struct {
+	class       ChangeClass
+	match       *regexp.Regexp
+	unless      *regexp.Regexp
+	description string
+	// lint is the id of the LintRule reporting the statements of the rule, if any
+	lint string
+}
+
+// changeRules are ordered from the most to the least severe class, the first matching rule classifies a statement.
+//
+//nolint:gochecknoglobals,lll
+var changeRules = []changeRule{
+	{ChangeClassDataLoss, regexp.MustCompile(`^drop table\b`), nil, "drops a table", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^drop schema\b`), nil, "drops a schema", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^drop sequence\b`), nil, "drops a sequence", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^drop type\b`), nil, "drops a type", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^alter table\b.*\bdrop column\b`), nil, "drops a column", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^truncate\b`), nil, "deletes all rows of a table", ""},
+	{ChangeClassDataLoss, regexp.MustCompile(`^delete from\b`), nil, "deletes rows", ""},
+	{ChangeClassTableRewrite, regexp.MustCompile(`^alter table\b.*\balter column ` + identifierPattern + ` (set data )?type\b`), nil, "changes the type of a column", "column-type-change"},
+	{ChangeClassTableRewrite, regexp.MustCompile(`^alter table\b.*\badd column\b.*\bgenerated always as \(.*\) stored\b`), nil, "adds a stored generated column", ""},
+	{ChangeClassTableRewrite, regexp.MustCompile(`^alter table\b.*\badd column\b.*\bdefault\b.*\b(random|gen_random_uuid|uuid_generate_v4|clock_timestamp|nextval)\(`), nil, "adds a column with a volatile default", "volatile-default"},
+	{ChangeClassTableRewrite, regexp.MustCompile(`^alter table\b.*\bset (tablespace|logged|unlogged)\b`), nil, "rewrites a table", ""},
+	{ChangeClassTableRewrite, regexp.MustCompile(`^(vacuum full|cluster)\b`), nil, "rewrites a table", ""},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^create (unique )?index\b`), regexp.MustCompile(`\bconcurrently\b`), "builds an index without concurrently", "non-concurrent-index"},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^alter table\b.*\badd\b.*\bforeign key\b`), regexp.MustCompile(`\bnot valid\b`), "adds a constraint without not valid", "foreign-key-not-valid"},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^alter table\b.*\badd\b.*\bcheck\b`), regexp.MustCompile(`\bnot valid\b`), "adds a constraint without not valid", "check-not-valid"},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^alter table\b.*\badd\b.*\b(primary key|unique)\b`), regexp.MustCompile(`\busing index\b`), "builds an index for a constraint", "constraint-without-index"},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^alter table\b.*\badd constraint\b.*\bexclude\b`), nil, "builds an index for a constraint", ""},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^alter table\b.*\bset not null\b`), nil, "scans the table to set not null", "set-not-null"},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^refresh materialized view\b`), regexp.MustCompile(`\bconcurrently\b`), "refreshes a materialized view without concurrently", ""},
+	{ChangeClassLockHeavy, regexp.MustCompile(`^lock\b`), nil, "locks a table", ""},
+}
+
+var regexpWhitespace = regexp.MustCompile(`\s+`)
+
+// identifierPattern matches a quoted or unquoted identifier of a normalized statement.
+const identifierPattern = `(?:"[^"]*"|[a-z_][a-z0-9_$]*)`
+
+// refusedMigrationHeader is the first line of the files written by RefusedMigration.
+const refusedMigrationHeader = "-- The statements of this migration lose data and have been commented out. Review them " +
+	"and add the line"
+
+// ClassifiedStatement is a statement together with its change class and the reason for the class.
+type ClassifiedStatement struct {
+	Statement
+	Class       ChangeClass
+	Description string
+}
+
+// ClassifyStatement returns the change class of a single statement.
+func ClassifyStatement(sql string) (ChangeClass, string) {
+	normalized := strings.ToLower(regexpWhitespace.ReplaceAllString(strings.TrimSpace(sql), " "))
+	for _, rule := range changeRules {
+		if rule.match.MatchString(normalized) && (rule.unless == nil || !rule.unless.MatchString(normalized)) {
+			return rule.class, rule.description
+		}
+	}
+
+	return ChangeClassSafe, ""
+}
+
+// ClassifyStatements returns the statements of the SQL which are not safe.
+func ClassifyStatements(sql string) []ClassifiedStatement {
+	var classified []ClassifiedStatement
+	for _, s := range SplitStatements(sql) {
+		class, description := ClassifyStatement(s.SQL)
+		if class != ChangeClassSafe {
+			classified = append(classified, ClassifiedStatement{
+				Statement:   s,
+				Class:       class,
+				Description: description,
+			})
+		}
+	}
+
+	return classified
+}
+
+// AnnotateStatements adds a warning comment above every statement which is not safe.
+func AnnotateStatements(sql string) (string, []ClassifiedStatement) {
+	classified := ClassifyStatements(sql)
+	if len(classified) == 0 {
+		return sql, nil
+	}
+
+	warnings := map[int][]string{}
+	for _, c := range classified {
+		warnings[c.Line] = append(warnings[c.Line], fmt.Sprintf("%s%s: %s", warningPrefix, c.Class, c.Description))
+	}
+
+	var lines []string
+	for i, line := range strings.Split(sql, "\n") {
+		lines = append(lines, warnings[i+1]...)
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n"), classified
+}
+
+// HasDataLoss returns whether any of the statements loses data.
+func HasDataLoss(classified []ClassifiedStatement) bool {
+	for _, c := range classified {
+		if c.Class == ChangeClassDataLoss {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasAllowDestructiveMarker returns whether the migration file exists and contains the AllowDestructiveMarker.
+func HasAllowDestructiveMarker(file string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read migration file: %w", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == AllowDestructiveMarker {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RefusedMigration returns the content of a migration file for statements which lose data and haven't been
+// acknowledged. The statements are commented out, so the migration doesn't change anything if it is applied, and the
+// AllowDestructiveMarker can be added to the file to acknowledge them.
+func RefusedMigration(statements string) string {
+	return commentOutStatements([]string{
+		refusedMigrationHeader,
+		fmt.Sprintf("-- %q to this file to write them at the next generation.", AllowDestructiveMarker),
+	}, statements)
+}
+
+// RefusedDownMigration returns the content of the down migration file of a RefusedMigration. Its statements are
+// commented out as well, so rolling back the refused migration doesn't change anything either.
+func RefusedDownMigration(statements string) string {
+	return commentOutStatements([]string{
+		"-- The statements of this down migration have been commented out, because its migration loses data and",
+		"-- hasn't been acknowledged yet.",
+	}, statements)
+}
+
+// IsRefusedMigration returns whether the migration has been written by RefusedMigration.
+func IsRefusedMigration(sql string) bool {
+	return strings.Contains(sql, refusedMigrationHeader)
+}
+
+func commentOutStatements(header []string, statements string) string {
+	lines := header
+	for _, line := range strings.Split(strings.TrimSuffix(statements, "\n"), "\n") {
+		lines = append(lines, strings.TrimSpace("-- "+line))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
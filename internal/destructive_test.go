@@ -0,0 +1,66 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		statement string
+		want      internal.ChangeClass
+	}{
+		{"DROP TABLE users;", internal.ChangeClassDataLoss},
+		{"ALTER TABLE users DROP COLUMN name;", internal.ChangeClassDataLoss},
+		{"ALTER TABLE users ALTER COLUMN name TYPE varchar(100);", internal.ChangeClassTableRewrite},
+		{"ALTER TABLE users ALTER COLUMN name SET DATA TYPE text;", internal.ChangeClassTableRewrite},
+		{`ALTER TABLE "users" ALTER COLUMN "type" TYPE text;`, internal.ChangeClassTableRewrite},
+		{`ALTER TABLE "users" ALTER COLUMN "type" SET NOT NULL;`, internal.ChangeClassLockHeavy},
+		{"ALTER TABLE users ALTER COLUMN type SET DEFAULT 'a';", internal.ChangeClassSafe},
+		{"ALTER TABLE users ADD COLUMN id uuid DEFAULT gen_random_uuid();", internal.ChangeClassTableRewrite},
+		{"ALTER TABLE users ADD COLUMN created_at timestamptz DEFAULT now();", internal.ChangeClassSafe},
+		{"CREATE INDEX users_name ON users (name);", internal.ChangeClassLockHeavy},
+		{"CREATE INDEX CONCURRENTLY users_name ON users (name);", internal.ChangeClassSafe},
+		{"CREATE TABLE users (id int);", internal.ChangeClassSafe},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.statement, func(t *testing.T) {
+			t.Parallel()
+
+			if got, _ := internal.ClassifyStatement(tt.statement); got != tt.want {
+				t.Errorf("ClassifyStatement() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefusedMigration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want bool
+	}{
+		{"refused", internal.RefusedMigration("DROP TABLE users;\n"), true},
+		{"acknowledged", "-- trek:allow-destructive\n" + internal.RefusedMigration("DROP TABLE users;\n"), true},
+		{"down migration", internal.RefusedDownMigration("CREATE TABLE users (id int);\n"), false},
+		{"written", "-- trek:allow-destructive\nDROP TABLE users;\n", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := internal.IsRefusedMigration(tt.sql); got != tt.want {
+				t.Errorf("IsRefusedMigration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
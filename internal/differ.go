@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/stack11/trek/internal/differ"
+)
+
+// DiffSchemas returns the statements to migrate the schema of the from database to the schema of the to database,
+// using the differ selected in the config.
+func DiffSchemas(ctx context.Context, config *Config, from, to *pgx.Conn) (string, error) {
+	if config.Differ == DifferNative {
+		statements, err := differ.Diff(ctx, from, to)
+		if err != nil {
+			return "", fmt.Errorf("failed to diff schemas: %w", err)
+		}
+
+		return statements, nil
+	}
+
+	return Migra(DSN(from, SSLMode(from)), DSN(to, SSLMode(to)))
+}
@@ -0,0 +1,801 @@
+// Package differ compares the schemas of two PostgreSQL databases and generates the statements needed to migrate from
+// one to the other. It is a native alternative to migra.
+package differ
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Diff returns the statements that migrate the schema of the from database to the schema of the to database.
+// The statements are separated by empty lines.
+func Diff(ctx context.Context, from, to *pgx.Conn) (string, error) {
+	fromSchema, err := Inspect(ctx, from)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect from database: %w", err)
+	}
+
+	toSchema, err := Inspect(ctx, to)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect to database: %w", err)
+	}
+
+	return strings.Join(Statements(fromSchema, toSchema), "\n\n"), nil
+}
+
+// Statements returns the ordered statements that migrate the from schema to the to schema.
+func Statements(from, to *Schema) []string {
+	d := &diff{from: from, to: to, recreated: map[string]struct{}{}, dependents: map[string]struct{}{}}
+
+	d.findDependents()
+	d.setCheckFunctionBodies()
+	d.createNamespaces()
+	d.createEnums()
+	d.createSequences()
+	d.dropTriggers()
+	d.dropViews()
+	d.dropConstraints()
+	d.dropIndexes()
+	d.dropDependentDefaults()
+	d.createFunctions()
+	d.createTables()
+	d.alterTables()
+	d.convertRecreatedEnums()
+	d.alterSequences()
+	d.dropTables()
+	d.addConstraints()
+	d.createIndexes()
+	d.createViews()
+	d.createTriggers()
+	d.dropFunctions()
+	d.dropSequences()
+	d.dropEnums()
+	d.dropNamespaces()
+	d.changeOwners()
+	d.changePrivileges()
+	d.changeDefaultPrivileges()
+
+	return d.statements
+}
+
+// PrivilegeStatements returns the statements that change the ownership, the privileges and the default privileges of
+// the from schema to the ones of the to schema, without changing any other objects.
+func PrivilegeStatements(from, to *Schema) []string {
+	d := &diff{from: from, to: to, recreated: map[string]struct{}{}, dependents: map[string]struct{}{}}
+
+	d.changeOwners()
+	d.changePrivileges()
+	d.changeDefaultPrivileges()
+
+	return d.statements
+}
+
+// DiffPrivileges returns the statements that change the ownership, the privileges and the default privileges of the
+// from database to the ones of the to database. The statements are separated by new lines.
+func DiffPrivileges(ctx context.Context, from, to *pgx.Conn) (string, error) {
+	fromSchema, err := Inspect(ctx, from)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect from database: %w", err)
+	}
+
+	toSchema, err := Inspect(ctx, to)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect to database: %w", err)
+	}
+
+	return strings.Join(PrivilegeStatements(fromSchema, toSchema), "\n"), nil
+}
+
+type diff struct {
+	from       *Schema
+	to         *Schema
+	statements []string
+	// recreated contains the keys of the objects which are dropped and created again and therefore lose their
+	// privileges.
+	recreated map[string]struct{}
+	// dependents contains the keys of the views, triggers and column defaults which are dropped and created again
+	// because objects they depend on are recreated or change their type.
+	dependents map[string]struct{}
+}
+
+func (d *diff) add(format string, args ...interface{}) {
+	d.statements = append(d.statements, fmt.Sprintf(format, args...))
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+func qualifiedName(schema, name string) string {
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+func functionKey(schema, name, args string) string {
+	return qualifiedName(schema, name) + "(" + args + ")"
+}
+
+// memberKey returns the key of a column or trigger of a table.
+func memberKey(table, kind, name string) string {
+	return table + " " + kind + " " + quoteIdent(name)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (d *diff) isDependent(key string) bool {
+	_, ok := d.dependents[key]
+
+	return ok
+}
+
+// findDependents collects the views, triggers and column defaults which have to be recreated. Views depending on a
+// table whose columns change their type, and objects depending on a recreated function would otherwise prevent the
+// change.
+//
+//nolint:cyclop
+func (d *diff) findDependents() {
+	changed := map[string]struct{}{}
+	for k := range d.from.Functions {
+		if d.functionRecreated(k) {
+			changed[k] = struct{}{}
+		}
+	}
+	for k, fromTable := range d.from.Tables {
+		t, ok := d.to.Tables[k]
+		if !ok {
+			continue
+		}
+		for _, fromColumn := range fromTable.Columns {
+			c := findColumn(t, fromColumn.Name)
+			if c == nil {
+				continue
+			}
+			if fromColumn.Type != c.Type || d.enumConverted(fromColumn, c) {
+				changed[k] = struct{}{}
+			}
+			if fromColumn.Default != "" && (d.enumConverted(fromColumn, c) ||
+				dependsOn(fromColumn.DefaultDependencies, changed)) {
+				d.dependents[memberKey(k, "column", c.Name)] = struct{}{}
+			}
+		}
+		for name, tr := range fromTable.Triggers {
+			if _, ok := t.Triggers[name]; ok && dependsOn(tr.Dependencies, changed) {
+				d.dependents[memberKey(k, "trigger", name)] = struct{}{}
+			}
+		}
+	}
+
+	// Views depend on the views created before them only, so the changes propagate in a single pass
+	for _, k := range sortedViews(d.from.Views) {
+		if _, ok := d.to.Views[k]; ok && dependsOn(d.from.Views[k].Dependencies, changed) {
+			changed[k] = struct{}{}
+			d.dependents[k] = struct{}{}
+		}
+	}
+}
+
+func dependsOn(dependencies []string, keys map[string]struct{}) bool {
+	for _, dependency := range dependencies {
+		if _, ok := keys[dependency]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findColumn(t *Table, name string) *Column {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (d *diff) setCheckFunctionBodies() {
+	for k, f := range d.to.Functions {
+		if fromFunction, ok := d.from.Functions[k]; !ok || fromFunction.Definition != f.Definition {
+			d.add("set check_function_bodies = off;")
+
+			return
+		}
+	}
+}
+
+func (d *diff) createNamespaces() {
+	for _, k := range sortedKeys(d.to.Namespaces) {
+		if _, ok := d.from.Namespaces[k]; !ok {
+			d.add("create schema if not exists %s;", k)
+		}
+	}
+}
+
+func (d *diff) dropNamespaces() {
+	for _, k := range sortedKeys(d.from.Namespaces) {
+		if _, ok := d.to.Namespaces[k]; !ok {
+			d.add("drop schema if exists %s;", k)
+		}
+	}
+}
+
+func enumLabels(labels []string) string {
+	quoted := make([]string, 0, len(labels))
+	for _, l := range labels {
+		quoted = append(quoted, quoteLiteral(l))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// enumAddedLabels returns the statements to add the missing labels if the labels of from are a subsequence of the
+// labels of to. If labels have been removed or reordered, ok is false.
+func enumAddedLabels(name string, from, to []string) (statements []string, ok bool) {
+	position := map[string]int{}
+	for i, l := range to {
+		position[l] = i
+	}
+
+	last := -1
+	existing := map[string]struct{}{}
+	for _, l := range from {
+		p, found := position[l]
+		if !found || p < last {
+			return nil, false
+		}
+		last = p
+		existing[l] = struct{}{}
+	}
+
+	for i, l := range to {
+		if _, found := existing[l]; found {
+			continue
+		}
+		if i > 0 {
+			statements = append(statements, fmt.Sprintf(
+				"alter type %s add value %s after %s;", name, quoteLiteral(l), quoteLiteral(to[i-1]),
+			))
+		} else {
+			statements = append(statements, fmt.Sprintf(
+				"alter type %s add value %s before %s;", name, quoteLiteral(l), quoteLiteral(to[i+1]),
+			))
+		}
+	}
+
+	return statements, true
+}
+
+// enumRecreated returns whether labels of the enum have been removed or reordered, so it has to be recreated.
+func (d *diff) enumRecreated(k string) bool {
+	fromEnum, ok := d.from.Enums[k]
+	if !ok {
+		return false
+	}
+	e, ok := d.to.Enums[k]
+	if !ok {
+		return false
+	}
+	_, added := enumAddedLabels(k, fromEnum.Labels, e.Labels)
+
+	return !added
+}
+
+// enumConverted returns whether the column keeps a recreated enum as its type and is converted to the new type.
+func (d *diff) enumConverted(from, to *Column) bool {
+	if from.Type != to.Type {
+		return false
+	}
+	for k, e := range d.to.Enums {
+		if e.TypeName == to.Type && d.enumRecreated(k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func enumRenamedName(e *Enum) string {
+	return qualifiedName(e.Schema, e.Name+"__old_version_to_be_dropped")
+}
+
+func (d *diff) createEnums() {
+	for _, k := range sortedKeys(d.to.Enums) {
+		e := d.to.Enums[k]
+		fromEnum, ok := d.from.Enums[k]
+		if !ok {
+			d.add("create type %s as enum (%s);", k, enumLabels(e.Labels))
+
+			continue
+		}
+
+		if !d.enumRecreated(k) {
+			statements, _ := enumAddedLabels(k, fromEnum.Labels, e.Labels)
+			d.statements = append(d.statements, statements...)
+
+			continue
+		}
+
+		// Labels have been removed or reordered, the type has to be recreated
+		d.recreated[k] = struct{}{}
+		d.add("alter type %s rename to %s;", k, quoteIdent(e.Name+"__old_version_to_be_dropped"))
+		d.add("create type %s as enum (%s);", k, enumLabels(e.Labels))
+	}
+}
+
+func (d *diff) convertRecreatedEnums() {
+	for _, k := range sortedKeys(d.to.Enums) {
+		if _, ok := d.recreated[k]; !ok {
+			continue
+		}
+		e := d.to.Enums[k]
+
+		for _, tk := range sortedKeys(d.to.Tables) {
+			fromTable, ok := d.from.Tables[tk]
+			if !ok {
+				continue
+			}
+			for _, c := range d.to.Tables[tk].Columns {
+				fromColumn := findColumn(fromTable, c.Name)
+				if c.Type != e.TypeName || fromColumn == nil || fromColumn.Type != c.Type {
+					continue
+				}
+				column := quoteIdent(c.Name)
+				d.add("alter table %s alter column %s type %s using %s::text::%s;", tk, column, k, column, k)
+				// The default has been dropped before, because it references the old type
+				if c.Generated == "" && c.Default != "" {
+					d.add("alter table %s alter column %s set default %s;", tk, column, c.Default)
+				}
+			}
+		}
+		d.add("drop type %s;", enumRenamedName(e))
+	}
+}
+
+func (d *diff) dropEnums() {
+	for _, k := range sortedKeys(d.from.Enums) {
+		if _, ok := d.to.Enums[k]; !ok {
+			d.add("drop type %s;", k)
+		}
+	}
+}
+
+func (d *diff) createSequences() {
+	for _, k := range sortedKeys(d.to.Sequences) {
+		q := d.to.Sequences[k]
+		if _, ok := d.from.Sequences[k]; ok {
+			continue
+		}
+
+		cycle := "no cycle"
+		if q.Cycle {
+			cycle = "cycle"
+		}
+		d.add(
+			"create sequence %s as %s increment by %d minvalue %d maxvalue %d start with %d cache %d %s;",
+			k, q.DataType, q.Increment, q.Min, q.Max, q.Start, q.Cache, cycle,
+		)
+	}
+}
+
+//nolint:cyclop
+func (d *diff) alterSequences() {
+	for _, k := range sortedKeys(d.to.Sequences) {
+		q := d.to.Sequences[k]
+		fromSequence, ok := d.from.Sequences[k]
+		if !ok {
+			if q.OwnedBy != "" {
+				d.add("alter sequence %s owned by %s;", k, q.OwnedBy)
+			}
+
+			continue
+		}
+
+		var changes []string
+		if fromSequence.DataType != q.DataType {
+			changes = append(changes, "as "+q.DataType)
+		}
+		if fromSequence.Increment != q.Increment {
+			changes = append(changes, fmt.Sprintf("increment by %d", q.Increment))
+		}
+		if fromSequence.Min != q.Min {
+			changes = append(changes, fmt.Sprintf("minvalue %d", q.Min))
+		}
+		if fromSequence.Max != q.Max {
+			changes = append(changes, fmt.Sprintf("maxvalue %d", q.Max))
+		}
+		if fromSequence.Start != q.Start {
+			changes = append(changes, fmt.Sprintf("start with %d", q.Start))
+		}
+		if fromSequence.Cache != q.Cache {
+			changes = append(changes, fmt.Sprintf("cache %d", q.Cache))
+		}
+		if fromSequence.Cycle != q.Cycle {
+			if q.Cycle {
+				changes = append(changes, "cycle")
+			} else {
+				changes = append(changes, "no cycle")
+			}
+		}
+		if len(changes) > 0 {
+			d.add("alter sequence %s %s;", k, strings.Join(changes, " "))
+		}
+
+		if fromSequence.OwnedBy != q.OwnedBy {
+			ownedBy := q.OwnedBy
+			if ownedBy == "" {
+				ownedBy = "none"
+			}
+			d.add("alter sequence %s owned by %s;", k, ownedBy)
+		}
+	}
+}
+
+func (d *diff) dropSequences() {
+	for _, k := range sortedKeys(d.from.Sequences) {
+		if _, ok := d.to.Sequences[k]; ok {
+			continue
+		}
+		// Sequences owned by a column are dropped together with the column or table
+		d.add("drop sequence if exists %s;", k)
+	}
+}
+
+func columnDefinition(c *Column) string {
+	definition := quoteIdent(c.Name) + " " + c.Type
+	switch {
+	case c.Generated == "s":
+		definition += " generated always as (" + c.Default + ") stored"
+	case c.Identity == "a":
+		definition += " generated always as identity"
+	case c.Identity == "d":
+		definition += " generated by default as identity"
+	case c.Default != "":
+		definition += " default " + c.Default
+	}
+	if c.NotNull {
+		definition += " not null"
+	}
+
+	return definition
+}
+
+func (d *diff) createTables() {
+	for _, k := range sortedKeys(d.to.Tables) {
+		t := d.to.Tables[k]
+		if _, ok := d.from.Tables[k]; ok {
+			continue
+		}
+
+		columns := make([]string, 0, len(t.Columns))
+		for _, c := range t.Columns {
+			columns = append(columns, "    "+columnDefinition(c))
+		}
+
+		statement := fmt.Sprintf("create table %s (\n%s\n)", k, strings.Join(columns, ",\n"))
+		if t.Partitioned {
+			statement += " partition by " + t.PartitionKey
+		}
+		d.add("%s;", statement)
+	}
+}
+
+//nolint:gocognit,cyclop
+func (d *diff) alterTables() {
+	for _, k := range sortedKeys(d.to.Tables) {
+		t := d.to.Tables[k]
+		fromTable, ok := d.from.Tables[k]
+		if !ok {
+			continue
+		}
+
+		fromColumns := map[string]*Column{}
+		for _, c := range fromTable.Columns {
+			fromColumns[c.Name] = c
+		}
+		toColumns := map[string]*Column{}
+		for _, c := range t.Columns {
+			toColumns[c.Name] = c
+		}
+
+		for _, c := range t.Columns {
+			fromColumn, ok := fromColumns[c.Name]
+			if !ok {
+				d.add("alter table %s add column %s;", k, columnDefinition(c))
+
+				continue
+			}
+
+			column := quoteIdent(c.Name)
+			if fromColumn.Generated != c.Generated ||
+				(c.Generated != "" && fromColumn.Default != c.Default) ||
+				fromColumn.Identity != c.Identity && fromColumn.Identity != "" && c.Identity != "" {
+				// Generated columns and identity kinds can't be altered in place
+				d.add("alter table %s drop column %s;", k, column)
+				d.add("alter table %s add column %s;", k, columnDefinition(c))
+
+				continue
+			}
+
+			fromDefault := fromColumn.Default
+			if d.isDependent(memberKey(k, "column", c.Name)) {
+				fromDefault = ""
+			}
+			defaultChanged := c.Generated == "" && fromDefault != c.Default
+			if defaultChanged && fromDefault != "" {
+				d.add("alter table %s alter column %s drop default;", k, column)
+			}
+			if fromColumn.Identity != "" && c.Identity == "" {
+				d.add("alter table %s alter column %s drop identity;", k, column)
+			}
+			if fromColumn.Type != c.Type {
+				d.add("alter table %s alter column %s type %s using %s::%s;", k, column, c.Type, column, c.Type)
+			}
+			// The default of a converted enum column is set after the conversion
+			if defaultChanged && c.Default != "" && !d.enumConverted(fromColumn, c) {
+				d.add("alter table %s alter column %s set default %s;", k, column, c.Default)
+			}
+			if fromColumn.NotNull != c.NotNull {
+				if c.NotNull {
+					d.add("alter table %s alter column %s set not null;", k, column)
+				} else {
+					d.add("alter table %s alter column %s drop not null;", k, column)
+				}
+			}
+			if fromColumn.Identity == "" && c.Identity != "" {
+				kind := "always"
+				if c.Identity == "d" {
+					kind = "by default"
+				}
+				d.add("alter table %s alter column %s add generated %s as identity;", k, column, kind)
+			}
+		}
+
+		for _, c := range fromTable.Columns {
+			if _, ok := toColumns[c.Name]; !ok {
+				d.add("alter table %s drop column %s;", k, quoteIdent(c.Name))
+			}
+		}
+	}
+}
+
+// dropDependentDefaults drops the defaults which reference a recreated function or enum before they are recreated.
+// alterTables and convertRecreatedEnums set them again.
+func (d *diff) dropDependentDefaults() {
+	for _, k := range sortedKeys(d.from.Tables) {
+		for _, c := range d.from.Tables[k].Columns {
+			if d.isDependent(memberKey(k, "column", c.Name)) {
+				d.add("alter table %s alter column %s drop default;", k, quoteIdent(c.Name))
+			}
+		}
+	}
+}
+
+func (d *diff) dropTables() {
+	for _, k := range sortedKeys(d.from.Tables) {
+		if _, ok := d.to.Tables[k]; !ok {
+			d.add("drop table %s;", k)
+		}
+	}
+}
+
+// dropConstraints drops removed and changed constraints, starting with the foreign keys because other constraints
+// might be referenced by them. Foreign keys of dropped tables are dropped as well, so that the tables can be dropped
+// in any order.
+func (d *diff) dropConstraints() {
+	for _, foreignKeys := range []bool{true, false} {
+		for _, k := range sortedKeys(d.from.Tables) {
+			fromTable := d.from.Tables[k]
+			t, tableExists := d.to.Tables[k]
+			for _, name := range sortedKeys(fromTable.Constraints) {
+				con := fromTable.Constraints[name]
+				if (con.Type == "f") != foreignKeys {
+					continue
+				}
+				if !tableExists {
+					if foreignKeys {
+						d.add("alter table %s drop constraint %s;", k, quoteIdent(name))
+					}
+
+					continue
+				}
+				if toConstraint, ok := t.Constraints[name]; !ok || toConstraint.Definition != con.Definition {
+					d.add("alter table %s drop constraint %s;", k, quoteIdent(name))
+				}
+			}
+		}
+	}
+}
+
+func (d *diff) addConstraints() {
+	for _, foreignKeys := range []bool{false, true} {
+		for _, k := range sortedKeys(d.to.Tables) {
+			t := d.to.Tables[k]
+			fromTable, tableExists := d.from.Tables[k]
+			for _, name := range sortedKeys(t.Constraints) {
+				con := t.Constraints[name]
+				if (con.Type == "f") != foreignKeys {
+					continue
+				}
+				if tableExists {
+					if fromConstraint, ok := fromTable.Constraints[name]; ok && fromConstraint.Definition == con.Definition {
+						continue
+					}
+				}
+				d.add("alter table %s add constraint %s %s;", k, quoteIdent(name), con.Definition)
+			}
+		}
+	}
+}
+
+func (d *diff) dropIndexes() {
+	for _, k := range sortedKeys(d.from.Tables) {
+		t, ok := d.to.Tables[k]
+		if !ok {
+			continue
+		}
+		fromTable := d.from.Tables[k]
+		for _, name := range sortedKeys(fromTable.Indexes) {
+			if i, ok := t.Indexes[name]; !ok || i.Definition != fromTable.Indexes[name].Definition {
+				d.add("drop index %s;", qualifiedName(fromTable.Schema, name))
+			}
+		}
+	}
+}
+
+func (d *diff) createIndexes() {
+	for _, k := range sortedKeys(d.to.Tables) {
+		t := d.to.Tables[k]
+		fromTable, tableExists := d.from.Tables[k]
+		for _, name := range sortedKeys(t.Indexes) {
+			i := t.Indexes[name]
+			if tableExists {
+				if fromIndex, ok := fromTable.Indexes[name]; ok && fromIndex.Definition == i.Definition {
+					continue
+				}
+			}
+			d.add("%s;", i.Definition)
+		}
+	}
+}
+
+func (d *diff) dropTriggers() {
+	for _, k := range sortedKeys(d.from.Tables) {
+		t, ok := d.to.Tables[k]
+		if !ok {
+			continue
+		}
+		fromTable := d.from.Tables[k]
+		for _, name := range sortedKeys(fromTable.Triggers) {
+			tr, ok := t.Triggers[name]
+			if !ok || tr.Definition != fromTable.Triggers[name].Definition || d.isDependent(memberKey(k, "trigger", name)) {
+				d.add("drop trigger if exists %s on %s;", quoteIdent(name), k)
+			}
+		}
+	}
+}
+
+func (d *diff) createTriggers() {
+	for _, k := range sortedKeys(d.to.Tables) {
+		t := d.to.Tables[k]
+		fromTable, tableExists := d.from.Tables[k]
+		for _, name := range sortedKeys(t.Triggers) {
+			tr := t.Triggers[name]
+			if tableExists {
+				fromTrigger, ok := fromTable.Triggers[name]
+				if ok && fromTrigger.Definition == tr.Definition && !d.isDependent(memberKey(k, "trigger", name)) {
+					continue
+				}
+			}
+			d.add("%s;", tr.Definition)
+		}
+	}
+}
+
+func viewKind(v *View) string {
+	if v.Materialized {
+		return "materialized view"
+	}
+
+	return "view"
+}
+
+// sortedViews returns the keys of the views in the order they have been created, which respects their dependencies.
+func sortedViews(views map[string]*View) []string {
+	keys := sortedKeys(views)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return views[keys[i]].OID < views[keys[j]].OID
+	})
+
+	return keys
+}
+
+func viewChanged(from, to *View) bool {
+	return from.Definition != to.Definition || from.Materialized != to.Materialized
+}
+
+func (d *diff) dropViews() {
+	keys := sortedViews(d.from.Views)
+	for i := len(keys) - 1; i >= 0; i-- {
+		k := keys[i]
+		v := d.from.Views[k]
+		if toView, ok := d.to.Views[k]; !ok || viewChanged(v, toView) || d.isDependent(k) {
+			d.add("drop %s if exists %s;", viewKind(v), k)
+		}
+	}
+}
+
+func (d *diff) createViews() {
+	for _, k := range sortedViews(d.to.Views) {
+		v := d.to.Views[k]
+		fromView, ok := d.from.Views[k]
+		if ok && !viewChanged(fromView, v) && !d.isDependent(k) {
+			continue
+		}
+		if ok {
+			d.recreated[k] = struct{}{}
+		}
+		d.add("create %s %s as %s", viewKind(v), k, strings.TrimSpace(v.Definition))
+	}
+}
+
+func functionKind(f *Function) string {
+	if f.Procedure {
+		return "procedure"
+	}
+
+	return "function"
+}
+
+// functionRecreated returns whether the function has to be dropped and created again, because create or replace can't
+// change its return type.
+func (d *diff) functionRecreated(k string) bool {
+	fromFunction, ok := d.from.Functions[k]
+	if !ok {
+		return false
+	}
+	f, ok := d.to.Functions[k]
+	if !ok {
+		return false
+	}
+
+	return fromFunction.Result != f.Result || fromFunction.Procedure != f.Procedure
+}
+
+func (d *diff) createFunctions() {
+	for _, k := range sortedKeys(d.to.Functions) {
+		f := d.to.Functions[k]
+		fromFunction, ok := d.from.Functions[k]
+		if ok && fromFunction.Definition == f.Definition {
+			continue
+		}
+		if d.functionRecreated(k) {
+			d.recreated[k] = struct{}{}
+			d.add("drop %s if exists %s;", functionKind(fromFunction), k)
+		}
+		d.add("%s;", strings.TrimSpace(f.Definition))
+	}
+}
+
+func (d *diff) dropFunctions() {
+	for _, k := range sortedKeys(d.from.Functions) {
+		if _, ok := d.to.Functions[k]; !ok {
+			d.add("drop %s if exists %s;", functionKind(d.from.Functions[k]), k)
+		}
+	}
+}
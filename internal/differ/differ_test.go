@@ -0,0 +1,295 @@
+package differ_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal/differ"
+)
+
+const (
+	usersTable  = `"public"."users"`
+	moodEnum    = `"public"."mood"`
+	activeView  = `"public"."active_users"`
+	namesView   = `"public"."user_names"`
+	statusFunc  = `"public"."status"()`
+	auditFunc   = `"public"."audit"()`
+	auditedName = "users_audit"
+)
+
+func newSchema() *differ.Schema {
+	return &differ.Schema{
+		Namespaces: map[string]*differ.Namespace{
+			`"public"`: {Name: "public", Owner: "postgres"},
+		},
+		Enums:       map[string]*differ.Enum{},
+		Sequences:   map[string]*differ.Sequence{},
+		Tables:      map[string]*differ.Table{},
+		Views:       map[string]*differ.View{},
+		Functions:   map[string]*differ.Function{},
+		DefaultACLs: map[string]*differ.DefaultACL{},
+	}
+}
+
+func withTable(s *differ.Schema, columns ...*differ.Column) *differ.Schema {
+	s.Tables[usersTable] = &differ.Table{
+		Schema:      "public",
+		Name:        "users",
+		Owner:       "postgres",
+		Columns:     columns,
+		Constraints: map[string]*differ.Constraint{},
+		Indexes:     map[string]*differ.Index{},
+		Triggers:    map[string]*differ.Trigger{},
+	}
+
+	return s
+}
+
+func withView(s *differ.Schema, key, name, definition string, oid uint32, dependencies ...string) *differ.Schema {
+	s.Views[key] = &differ.View{
+		Schema:       "public",
+		Name:         name,
+		Owner:        "postgres",
+		Definition:   definition,
+		OID:          oid,
+		Dependencies: dependencies,
+	}
+
+	return s
+}
+
+func withEnum(s *differ.Schema, labels ...string) *differ.Schema {
+	s.Enums[moodEnum] = &differ.Enum{
+		Schema:   "public",
+		Name:     "mood",
+		Owner:    "postgres",
+		TypeName: "mood",
+		Labels:   labels,
+	}
+
+	return s
+}
+
+func withFunction(s *differ.Schema, key, name, result, definition string) *differ.Schema {
+	s.Functions[key] = &differ.Function{
+		Schema:     "public",
+		Name:       name,
+		Owner:      "postgres",
+		Result:     result,
+		Definition: definition,
+	}
+
+	return s
+}
+
+func withTrigger(s *differ.Schema, definition string, dependencies ...string) *differ.Schema {
+	s.Tables[usersTable].Triggers[auditedName] = &differ.Trigger{
+		Name:         auditedName,
+		Definition:   definition,
+		Dependencies: dependencies,
+	}
+
+	return s
+}
+
+//nolint:lll
+const (
+	statusText    = "CREATE OR REPLACE FUNCTION public.status()\n RETURNS text\n LANGUAGE sql\nAS $function$SELECT 'active'$function$\n"
+	statusVarchar = "CREATE OR REPLACE FUNCTION public.status()\n RETURNS character varying\n LANGUAGE sql\nAS $function$SELECT 'active'::varchar$function$\n"
+	statusTextNew = "CREATE OR REPLACE FUNCTION public.status()\n RETURNS text\n LANGUAGE sql\nAS $function$SELECT 'enabled'$function$\n"
+	auditTrigger  = "CREATE OR REPLACE FUNCTION public.audit()\n RETURNS trigger\n LANGUAGE plpgsql\nAS $function$BEGIN RETURN NEW; END$function$\n"
+	auditTuple    = "CREATE OR REPLACE FUNCTION public.audit()\n RETURNS record\n LANGUAGE plpgsql\nAS $function$BEGIN RETURN NEW; END$function$\n"
+	auditOnUsers  = "CREATE TRIGGER users_audit BEFORE UPDATE ON public.users FOR EACH ROW EXECUTE FUNCTION audit()"
+)
+
+//nolint:maintidx,lll
+func TestStatements(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		from *differ.Schema
+		to   *differ.Schema
+		want []string
+	}{
+		{
+			name: "no changes",
+			from: withTable(newSchema(), &differ.Column{Name: "id", Type: "integer", NotNull: true}),
+			to:   withTable(newSchema(), &differ.Column{Name: "id", Type: "integer", NotNull: true}),
+			want: nil,
+		},
+		{
+			name: "create table",
+			from: newSchema(),
+			to: withTable(newSchema(),
+				&differ.Column{Name: "id", Type: "integer", NotNull: true},
+				&differ.Column{Name: "name", Type: "text", Default: "''::text"},
+			),
+			want: []string{
+				"create table \"public\".\"users\" (\n    \"id\" integer not null,\n    \"name\" text default ''::text\n);",
+			},
+		},
+		{
+			name: "add and drop columns",
+			from: withTable(newSchema(), &differ.Column{Name: "id", Type: "integer"}, &differ.Column{Name: "age", Type: "integer"}),
+			to:   withTable(newSchema(), &differ.Column{Name: "id", Type: "integer"}, &differ.Column{Name: "name", Type: "text"}),
+			want: []string{
+				`alter table "public"."users" add column "name" text;`,
+				`alter table "public"."users" drop column "age";`,
+			},
+		},
+		{
+			name: "column type change without dependent view",
+			from: withView(withTable(newSchema(), &differ.Column{Name: "id", Type: "integer"}),
+				activeView, "active_users", " SELECT 1;", 10),
+			to: withView(withTable(newSchema(), &differ.Column{Name: "id", Type: "bigint"}),
+				activeView, "active_users", " SELECT 1;", 10),
+			want: []string{
+				`alter table "public"."users" alter column "id" type bigint using "id"::bigint;`,
+			},
+		},
+		{
+			name: "column type change recreates dependent views",
+			from: withView(
+				withView(withTable(newSchema(), &differ.Column{Name: "id", Type: "integer"}),
+					activeView, "active_users", " SELECT users.id FROM users;", 10, usersTable),
+				namesView, "user_names", " SELECT active_users.id FROM active_users;", 11, activeView),
+			to: withView(
+				withView(withTable(newSchema(), &differ.Column{Name: "id", Type: "bigint"}),
+					activeView, "active_users", " SELECT users.id FROM users;", 10, usersTable),
+				namesView, "user_names", " SELECT active_users.id FROM active_users;", 11, activeView),
+			want: []string{
+				`drop view if exists "public"."user_names";`,
+				`drop view if exists "public"."active_users";`,
+				`alter table "public"."users" alter column "id" type bigint using "id"::bigint;`,
+				`create view "public"."active_users" as SELECT users.id FROM users;`,
+				`create view "public"."user_names" as SELECT active_users.id FROM active_users;`,
+			},
+		},
+		{
+			name: "enum label added",
+			from: withTable(withEnum(newSchema(), "happy", "sad"), &differ.Column{Name: "mood", Type: "mood"}),
+			to:   withTable(withEnum(newSchema(), "happy", "ok", "sad"), &differ.Column{Name: "mood", Type: "mood"}),
+			want: []string{
+				`alter type "public"."mood" add value 'ok' after 'happy';`,
+			},
+		},
+		{
+			name: "enum recreated with column default",
+			from: withTable(withEnum(newSchema(), "happy", "ok", "sad"),
+				&differ.Column{Name: "mood", Type: "mood", Default: "'ok'::mood"}),
+			to: withTable(withEnum(newSchema(), "happy", "sad"),
+				&differ.Column{Name: "mood", Type: "mood", Default: "'happy'::mood"}),
+			want: []string{
+				`alter type "public"."mood" rename to "mood__old_version_to_be_dropped";`,
+				`create type "public"."mood" as enum ('happy', 'sad');`,
+				`alter table "public"."users" alter column "mood" drop default;`,
+				`alter table "public"."users" alter column "mood" type "public"."mood" using "mood"::text::"public"."mood";`,
+				`alter table "public"."users" alter column "mood" set default 'happy'::mood;`,
+				`drop type "public"."mood__old_version_to_be_dropped";`,
+			},
+		},
+		{
+			name: "enum recreated with unchanged column default and dependent view",
+			from: withView(withTable(withEnum(newSchema(), "happy", "sad"),
+				&differ.Column{Name: "mood", Type: "mood", Default: "'happy'::mood"}),
+				activeView, "active_users", " SELECT users.mood FROM users;", 10, usersTable),
+			to: withView(withTable(withEnum(newSchema(), "sad", "happy"),
+				&differ.Column{Name: "mood", Type: "mood", Default: "'happy'::mood"}),
+				activeView, "active_users", " SELECT users.mood FROM users;", 10, usersTable),
+			want: []string{
+				`alter type "public"."mood" rename to "mood__old_version_to_be_dropped";`,
+				`create type "public"."mood" as enum ('sad', 'happy');`,
+				`drop view if exists "public"."active_users";`,
+				`alter table "public"."users" alter column "mood" drop default;`,
+				`alter table "public"."users" alter column "mood" type "public"."mood" using "mood"::text::"public"."mood";`,
+				`alter table "public"."users" alter column "mood" set default 'happy'::mood;`,
+				`drop type "public"."mood__old_version_to_be_dropped";`,
+				`create view "public"."active_users" as SELECT users.mood FROM users;`,
+			},
+		},
+		{
+			name: "enum recreated with new column default",
+			from: withTable(withEnum(newSchema(), "happy", "ok", "sad"), &differ.Column{Name: "mood", Type: "mood"}),
+			to: withTable(withEnum(newSchema(), "happy", "sad"),
+				&differ.Column{Name: "mood", Type: "mood", Default: "'happy'::mood"}),
+			want: []string{
+				`alter type "public"."mood" rename to "mood__old_version_to_be_dropped";`,
+				`create type "public"."mood" as enum ('happy', 'sad');`,
+				`alter table "public"."users" alter column "mood" type "public"."mood" using "mood"::text::"public"."mood";`,
+				`alter table "public"."users" alter column "mood" set default 'happy'::mood;`,
+				`drop type "public"."mood__old_version_to_be_dropped";`,
+			},
+		},
+		{
+			name: "function body change",
+			from: withFunction(newSchema(), statusFunc, "status", "text", statusText),
+			to:   withFunction(newSchema(), statusFunc, "status", "text", statusTextNew),
+			want: []string{
+				"set check_function_bodies = off;",
+				"CREATE OR REPLACE FUNCTION public.status()\n RETURNS text\n LANGUAGE sql\nAS $function$SELECT 'enabled'$function$;",
+			},
+		},
+		{
+			name: "function return type change recreates dependent views and defaults",
+			from: withView(
+				withTable(withFunction(newSchema(), statusFunc, "status", "text", statusText),
+					&differ.Column{
+						Name:                "status",
+						Type:                "text",
+						Default:             "public.status()",
+						DefaultDependencies: []string{statusFunc},
+					}),
+				activeView, "active_users", " SELECT public.status() AS status;", 10, statusFunc),
+			to: withView(
+				withTable(withFunction(newSchema(), statusFunc, "status", "character varying", statusVarchar),
+					&differ.Column{
+						Name:                "status",
+						Type:                "text",
+						Default:             "public.status()",
+						DefaultDependencies: []string{statusFunc},
+					}),
+				activeView, "active_users", " SELECT public.status() AS status;", 10, statusFunc),
+			want: []string{
+				"set check_function_bodies = off;",
+				`drop view if exists "public"."active_users";`,
+				`alter table "public"."users" alter column "status" drop default;`,
+				`drop function if exists "public"."status"();`,
+				"CREATE OR REPLACE FUNCTION public.status()\n RETURNS character varying\n LANGUAGE sql\n" +
+					"AS $function$SELECT 'active'::varchar$function$;",
+				`alter table "public"."users" alter column "status" set default public.status();`,
+				`create view "public"."active_users" as SELECT public.status() AS status;`,
+			},
+		},
+		{
+			name: "function return type change recreates dependent triggers",
+			from: withTrigger(
+				withTable(withFunction(newSchema(), auditFunc, "audit", "trigger", auditTrigger),
+					&differ.Column{Name: "id", Type: "integer"}),
+				auditOnUsers, usersTable, auditFunc),
+			to: withTrigger(
+				withTable(withFunction(newSchema(), auditFunc, "audit", "record", auditTuple),
+					&differ.Column{Name: "id", Type: "integer"}),
+				auditOnUsers, usersTable, auditFunc),
+			want: []string{
+				"set check_function_bodies = off;",
+				`drop trigger if exists "users_audit" on "public"."users";`,
+				`drop function if exists "public"."audit"();`,
+				"CREATE OR REPLACE FUNCTION public.audit()\n RETURNS record\n LANGUAGE plpgsql\n" +
+					"AS $function$BEGIN RETURN NEW; END$function$;",
+				auditOnUsers + ";",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := differ.Statements(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Statements() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
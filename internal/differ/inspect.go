@@ -0,0 +1,764 @@
+package differ
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// namespaceFilter excludes the system schemas. It expects the pg_namespace table to be aliased as n.
+const namespaceFilter = `n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg\_toast%'
+	AND n.nspname NOT LIKE 'pg\_temp\_%'`
+
+// Schema is the introspected state of a database.
+type Schema struct {
+	Namespaces map[string]*Namespace
+	Enums      map[string]*Enum
+	Sequences  map[string]*Sequence
+	Tables     map[string]*Table
+	Views      map[string]*View
+	Functions  map[string]*Function
+	// DefaultACLs are the default privileges, keyed by role, schema and object type.
+	DefaultACLs map[string]*DefaultACL
+	// serverVersion is the server_version_num of the inspected database, which decides the catalog columns to query
+	serverVersion int
+}
+
+type Privilege struct {
+	Grantee   string
+	Type      string
+	Grantable bool
+}
+
+type Namespace struct {
+	Name              string
+	Owner             string
+	Privileges        []Privilege
+	DefaultPrivileges []Privilege
+}
+
+type Enum struct {
+	Schema string
+	Name   string
+	Owner  string
+	// TypeName is the name as it is printed by format_type, which is how columns reference the enum.
+	TypeName string
+	Labels   []string
+}
+
+type Sequence struct {
+	Schema            string
+	Name              string
+	Owner             string
+	DataType          string
+	Start             int64
+	Increment         int64
+	Min               int64
+	Max               int64
+	Cache             int64
+	Cycle             bool
+	OwnedBy           string
+	Privileges        []Privilege
+	DefaultPrivileges []Privilege
+}
+
+// Table is a regular or partitioned table. Partitions are not supported.
+type Table struct {
+	Schema            string
+	Name              string
+	Owner             string
+	Partitioned       bool
+	PartitionKey      string
+	Columns           []*Column
+	Constraints       map[string]*Constraint
+	Indexes           map[string]*Index
+	Triggers          map[string]*Trigger
+	Privileges        []Privilege
+	DefaultPrivileges []Privilege
+}
+
+type Column struct {
+	Name      string
+	Type      string
+	NotNull   bool
+	Default   string
+	Identity  string
+	Generated string
+	// DefaultDependencies are the keys of the relations and functions referenced by the default.
+	DefaultDependencies []string
+}
+
+type Constraint struct {
+	Name       string
+	Type       string
+	Definition string
+}
+
+type Index struct {
+	Name       string
+	Definition string
+}
+
+type Trigger struct {
+	Name       string
+	Definition string
+	// Dependencies are the keys of the relations and functions referenced by the trigger, e.g. its function.
+	Dependencies []string
+}
+
+type View struct {
+	Schema       string
+	Name         string
+	Owner        string
+	Materialized bool
+	Definition   string
+	OID          uint32
+	// Dependencies are the keys of the tables, views and functions referenced by the view.
+	Dependencies      []string
+	Privileges        []Privilege
+	DefaultPrivileges []Privilege
+}
+
+// DefaultACL are the privileges granted by ALTER DEFAULT PRIVILEGES for the objects created by a role.
+type DefaultACL struct {
+	Role string
+	// Schema is empty if the default privileges apply to all schemas.
+	Schema string
+	// ObjectType is r (tables), S (sequences), f (functions), T (types) or n (schemas).
+	ObjectType string
+	Privileges []Privilege
+	// DefaultPrivileges are the privileges which apply if there is no entry for the role, schema and object type.
+	DefaultPrivileges []Privilege
+}
+
+type Function struct {
+	Schema            string
+	Name              string
+	Owner             string
+	IdentityArguments string
+	Result            string
+	Procedure         bool
+	Definition        string
+	Privileges        []Privilege
+	DefaultPrivileges []Privilege
+}
+
+// Inspect reads the schema of the database from pg_catalog.
+// The search_path is emptied for the duration of the inspection so that all names are schema qualified.
+//
+//nolint:cyclop
+func Inspect(ctx context.Context, conn *pgx.Conn) (*Schema, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	_, err = tx.Exec(ctx, "SET LOCAL search_path TO ''")
+	if err != nil {
+		return nil, fmt.Errorf("failed to set search_path: %w", err)
+	}
+
+	var serverVersion int
+	err = tx.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&serverVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+
+	s := &Schema{
+		serverVersion: serverVersion,
+		Namespaces:    map[string]*Namespace{},
+		Enums:         map[string]*Enum{},
+		Sequences:     map[string]*Sequence{},
+		Tables:        map[string]*Table{},
+		Views:         map[string]*View{},
+		Functions:     map[string]*Function{},
+		DefaultACLs:   map[string]*DefaultACL{},
+	}
+
+	for _, inspect := range []func(context.Context, pgx.Tx, *Schema) error{
+		inspectNamespaces,
+		inspectEnums,
+		inspectSequences,
+		inspectTables,
+		inspectColumns,
+		inspectConstraints,
+		inspectIndexes,
+		inspectTriggers,
+		inspectViews,
+		inspectFunctions,
+		inspectDependencies,
+		inspectDefaultACLs,
+	} {
+		err = inspect(ctx, tx, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func notExtensionMember(catalog, oid string) string {
+	return fmt.Sprintf(
+		"NOT EXISTS (SELECT 1 FROM pg_depend e WHERE e.classid = '%s'::regclass AND e.objid = %s AND e.deptype = 'e')",
+		catalog,
+		oid,
+	)
+}
+
+// queryPrivileges returns the privileges per object of the objects in from, which must alias the namespace as n.
+// The privileges are read from the access control list acl. name and args are the expressions of the name and the
+// identity arguments of the object, key builds the object key from the namespace, name and arguments.
+func queryPrivileges(
+	ctx context.Context,
+	tx pgx.Tx,
+	from,
+	name,
+	args,
+	acl string,
+	key func(schema, name, args string) string,
+) (map[string][]Privilege, error) {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, %s, %s, coalesce(r.rolname, 'PUBLIC'),
+			a.privilege_type, a.is_grantable
+		FROM %s, aclexplode(%s) a
+		LEFT JOIN pg_roles r ON r.oid = a.grantee
+		WHERE %s`, name, args, from, acl, namespaceFilter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query privileges: %w", err)
+	}
+	defer rows.Close()
+
+	privileges := map[string][]Privilege{}
+	for rows.Next() {
+		var schemaName, objectName, objectArgs string
+		var p Privilege
+		err = rows.Scan(&schemaName, &objectName, &objectArgs, &p.Grantee, &p.Type, &p.Grantable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan privilege: %w", err)
+		}
+		k := key(schemaName, objectName, objectArgs)
+		privileges[k] = append(privileges[k], p)
+	}
+
+	//nolint:wrapcheck
+	return privileges, rows.Err()
+}
+
+func inspectNamespaces(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, pg_get_userbyid(n.nspowner)
+		FROM pg_namespace n
+		WHERE %s AND %s`, namespaceFilter, notExtensionMember("pg_namespace", "n.oid")))
+	if err != nil {
+		return fmt.Errorf("failed to query schemas: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		n := &Namespace{}
+		err = rows.Scan(&n.Name, &n.Owner)
+		if err != nil {
+			return fmt.Errorf("failed to scan schema: %w", err)
+		}
+		s.Namespaces[quoteIdent(n.Name)] = n
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query schemas: %w", err)
+	}
+
+	key := func(schema, name, args string) string {
+		return quoteIdent(schema)
+	}
+	privileges, err := queryPrivileges(ctx, tx, "pg_namespace n", "''", "''",
+		"coalesce(n.nspacl, acldefault('n', n.nspowner))", key)
+	if err != nil {
+		return err
+	}
+	defaultPrivileges, err := queryPrivileges(ctx, tx, "pg_namespace n", "''", "''",
+		"acldefault('n', n.nspowner)", key)
+	if err != nil {
+		return err
+	}
+	for k, n := range s.Namespaces {
+		n.Privileges = privileges[k]
+		n.DefaultPrivileges = defaultPrivileges[k]
+	}
+
+	return nil
+}
+
+func inspectEnums(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, t.typname, pg_get_userbyid(t.typowner),
+			format_type(t.oid, NULL), array_agg(e.enumlabel::text ORDER BY e.enumsortorder)
+		FROM pg_type t
+		JOIN pg_enum e ON e.enumtypid = t.oid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE %s AND %s
+		GROUP BY n.nspname, t.typname, t.typowner, t.oid`, namespaceFilter, notExtensionMember("pg_type", "t.oid")))
+	if err != nil {
+		return fmt.Errorf("failed to query enums: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &Enum{}
+		err = rows.Scan(&e.Schema, &e.Name, &e.Owner, &e.TypeName, &e.Labels)
+		if err != nil {
+			return fmt.Errorf("failed to scan enum: %w", err)
+		}
+		s.Enums[qualifiedName(e.Schema, e.Name)] = e
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func inspectSequences(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, pg_get_userbyid(c.relowner),
+			format_type(q.seqtypid, NULL), q.seqstart, q.seqincrement, q.seqmin, q.seqmax, q.seqcache, q.seqcycle,
+			coalesce((
+				SELECT quote_ident(tn.nspname) || '.' || quote_ident(t.relname) || '.' || quote_ident(a.attname)
+				FROM pg_depend d
+				JOIN pg_class t ON t.oid = d.refobjid
+				JOIN pg_namespace tn ON tn.oid = t.relnamespace
+				JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'a'
+				LIMIT 1
+			), '')
+		FROM pg_class c
+		JOIN pg_sequence q ON q.seqrelid = c.oid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'S' AND %s AND %s
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'i'
+			)`, namespaceFilter, notExtensionMember("pg_class", "c.oid")))
+	if err != nil {
+		return fmt.Errorf("failed to query sequences: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		q := &Sequence{}
+		err = rows.Scan(&q.Schema, &q.Name, &q.Owner, &q.DataType, &q.Start, &q.Increment, &q.Min, &q.Max, &q.Cache,
+			&q.Cycle, &q.OwnedBy)
+		if err != nil {
+			return fmt.Errorf("failed to scan sequence: %w", err)
+		}
+		s.Sequences[qualifiedName(q.Schema, q.Name)] = q
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query sequences: %w", err)
+	}
+
+	return inspectRelationPrivileges(ctx, tx, "s", func(key string, privileges, defaultPrivileges []Privilege) {
+		if q, ok := s.Sequences[key]; ok {
+			q.Privileges = privileges
+			q.DefaultPrivileges = defaultPrivileges
+		}
+	})
+}
+
+func inspectTables(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, pg_get_userbyid(c.relowner),
+			c.relkind = 'p', coalesce(pg_get_partkeydef(c.oid), '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND NOT c.relispartition AND %s AND %s`,
+		namespaceFilter,
+		notExtensionMember("pg_class", "c.oid"),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to query tables: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := &Table{
+			Constraints: map[string]*Constraint{},
+			Indexes:     map[string]*Index{},
+			Triggers:    map[string]*Trigger{},
+		}
+		err = rows.Scan(&t.Schema, &t.Name, &t.Owner, &t.Partitioned, &t.PartitionKey)
+		if err != nil {
+			return fmt.Errorf("failed to scan table: %w", err)
+		}
+		s.Tables[qualifiedName(t.Schema, t.Name)] = t
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query tables: %w", err)
+	}
+
+	return inspectRelationPrivileges(ctx, tx, "r", func(key string, privileges, defaultPrivileges []Privilege) {
+		if t, ok := s.Tables[key]; ok {
+			t.Privileges = privileges
+			t.DefaultPrivileges = defaultPrivileges
+		}
+	})
+}
+
+func inspectRelationPrivileges(
+	ctx context.Context,
+	tx pgx.Tx,
+	aclType string,
+	set func(key string, privileges, defaultPrivileges []Privilege),
+) error {
+	key := func(schema, name, args string) string {
+		return qualifiedName(schema, name)
+	}
+	from := "pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace"
+	privileges, err := queryPrivileges(ctx, tx, from, "c.relname", "''",
+		fmt.Sprintf("coalesce(c.relacl, acldefault('%s', c.relowner))", aclType), key)
+	if err != nil {
+		return err
+	}
+	defaultPrivileges, err := queryPrivileges(ctx, tx, from, "c.relname", "''",
+		fmt.Sprintf("acldefault('%s', c.relowner)", aclType), key)
+	if err != nil {
+		return err
+	}
+	for k := range privileges {
+		set(k, privileges[k], defaultPrivileges[k])
+	}
+
+	return nil
+}
+
+func inspectColumns(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	// Generated columns exist since PostgreSQL 12
+	generated := "''"
+	if s.serverVersion >= 120000 {
+		generated = "a.attgenerated::text"
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, a.attname,
+			format_type(a.atttypid, a.atttypmod), a.attnotnull, coalesce(pg_get_expr(d.adbin, d.adrelid), ''),
+			a.attidentity::text, %s
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped AND %s
+		ORDER BY n.nspname, c.relname, a.attnum`, generated, namespaceFilter))
+	if err != nil {
+		return fmt.Errorf("failed to query columns: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName string
+		col := &Column{}
+		err = rows.Scan(&schemaName, &tableName, &col.Name, &col.Type, &col.NotNull, &col.Default, &col.Identity,
+			&col.Generated)
+		if err != nil {
+			return fmt.Errorf("failed to scan column: %w", err)
+		}
+		if t, ok := s.Tables[qualifiedName(schemaName, tableName)]; ok {
+			t.Columns = append(t.Columns, col)
+		}
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func inspectConstraints(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, con.conname, con.contype::text,
+			pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype IN ('p', 'u', 'f', 'c', 'x') AND con.conislocal AND %s`, namespaceFilter))
+	if err != nil {
+		return fmt.Errorf("failed to query constraints: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName string
+		con := &Constraint{}
+		err = rows.Scan(&schemaName, &tableName, &con.Name, &con.Type, &con.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to scan constraint: %w", err)
+		}
+		if t, ok := s.Tables[qualifiedName(schemaName, tableName)]; ok {
+			t.Constraints[con.Name] = con
+		}
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func inspectIndexes(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, i.relname, pg_get_indexdef(i.oid)
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN pg_class c ON c.oid = x.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE %s AND NOT EXISTS (
+			SELECT 1 FROM pg_constraint con
+			WHERE con.conindid = x.indexrelid AND con.conrelid = x.indrelid AND con.contype IN ('p', 'u', 'x')
+		)`, namespaceFilter))
+	if err != nil {
+		return fmt.Errorf("failed to query indexes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName string
+		i := &Index{}
+		err = rows.Scan(&schemaName, &tableName, &i.Name, &i.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to scan index: %w", err)
+		}
+		if t, ok := s.Tables[qualifiedName(schemaName, tableName)]; ok {
+			t.Indexes[i.Name] = i
+		}
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func inspectTriggers(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, t.tgname, pg_get_triggerdef(t.oid)
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND %s`, namespaceFilter))
+	if err != nil {
+		return fmt.Errorf("failed to query triggers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName string
+		tr := &Trigger{}
+		err = rows.Scan(&schemaName, &tableName, &tr.Name, &tr.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to scan trigger: %w", err)
+		}
+		if t, ok := s.Tables[qualifiedName(schemaName, tableName)]; ok {
+			t.Triggers[tr.Name] = tr
+		}
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func inspectViews(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, c.relname, pg_get_userbyid(c.relowner), c.relkind = 'm',
+			pg_get_viewdef(c.oid, true), c.oid
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND %s AND %s`, namespaceFilter, notExtensionMember("pg_class", "c.oid")))
+	if err != nil {
+		return fmt.Errorf("failed to query views: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v := &View{}
+		err = rows.Scan(&v.Schema, &v.Name, &v.Owner, &v.Materialized, &v.Definition, &v.OID)
+		if err != nil {
+			return fmt.Errorf("failed to scan view: %w", err)
+		}
+		s.Views[qualifiedName(v.Schema, v.Name)] = v
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query views: %w", err)
+	}
+
+	return inspectRelationPrivileges(ctx, tx, "r", func(key string, privileges, defaultPrivileges []Privilege) {
+		if v, ok := s.Views[key]; ok {
+			v.Privileges = privileges
+			v.DefaultPrivileges = defaultPrivileges
+		}
+	})
+}
+
+func inspectFunctions(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	// Procedures and prokind exist since PostgreSQL 11, before aggregate and window functions were flagged
+	procedure, kind := "p.prokind = 'p'", "p.prokind IN ('f', 'p')"
+	if s.serverVersion < 110000 {
+		procedure, kind = "false", "NOT p.proisagg AND NOT p.proiswindow"
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT n.nspname, p.proname, pg_get_userbyid(p.proowner),
+			pg_get_function_identity_arguments(p.oid), coalesce(pg_get_function_result(p.oid), ''), %s,
+			pg_get_functiondef(p.oid)
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE %s AND %s AND %s`, procedure, kind, namespaceFilter, notExtensionMember("pg_proc", "p.oid")))
+	if err != nil {
+		return fmt.Errorf("failed to query functions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := &Function{}
+		err = rows.Scan(&f.Schema, &f.Name, &f.Owner, &f.IdentityArguments, &f.Result, &f.Procedure, &f.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to scan function: %w", err)
+		}
+		s.Functions[functionKey(f.Schema, f.Name, f.IdentityArguments)] = f
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query functions: %w", err)
+	}
+
+	from := "pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace"
+	args := "pg_get_function_identity_arguments(p.oid)"
+	privileges, err := queryPrivileges(ctx, tx, from, "p.proname", args,
+		"coalesce(p.proacl, acldefault('f', p.proowner))", functionKey)
+	if err != nil {
+		return err
+	}
+	defaultPrivileges, err := queryPrivileges(ctx, tx, from, "p.proname", args,
+		"acldefault('f', p.proowner)", functionKey)
+	if err != nil {
+		return err
+	}
+	for k, f := range s.Functions {
+		f.Privileges = privileges[k]
+		f.DefaultPrivileges = defaultPrivileges[k]
+	}
+
+	return nil
+}
+
+// inspectDependencies reads the relations and functions referenced by views, triggers and column defaults from
+// pg_depend, which decide the objects that have to be recreated together with a changed one.
+func inspectDependencies(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf(`WITH dependencies AS (
+			SELECT 'view' AS kind, c.relnamespace, c.relname, '' AS member, d.refclassid, d.refobjid
+			FROM pg_depend d
+			JOIN pg_rewrite w ON w.oid = d.objid
+			JOIN pg_class c ON c.oid = w.ev_class
+			WHERE d.classid = 'pg_rewrite'::regclass AND d.refobjid <> w.ev_class
+			UNION ALL
+			SELECT 'trigger', c.relnamespace, c.relname, t.tgname, d.refclassid, d.refobjid
+			FROM pg_depend d
+			JOIN pg_trigger t ON t.oid = d.objid
+			JOIN pg_class c ON c.oid = t.tgrelid
+			WHERE d.classid = 'pg_trigger'::regclass AND NOT t.tgisinternal
+			UNION ALL
+			SELECT 'default', c.relnamespace, c.relname, a.attname, d.refclassid, d.refobjid
+			FROM pg_depend d
+			JOIN pg_attrdef ad ON ad.oid = d.objid
+			JOIN pg_class c ON c.oid = ad.adrelid
+			JOIN pg_attribute a ON a.attrelid = ad.adrelid AND a.attnum = ad.adnum
+			WHERE d.classid = 'pg_attrdef'::regclass
+		)
+		SELECT DISTINCT dep.kind, n.nspname, dep.relname, dep.member, rn.nspname, coalesce(r.relname, p.proname),
+			p.oid IS NOT NULL, coalesce(pg_get_function_identity_arguments(p.oid), '')
+		FROM dependencies dep
+		JOIN pg_namespace n ON n.oid = dep.relnamespace
+		LEFT JOIN pg_class r ON dep.refclassid = 'pg_class'::regclass AND r.oid = dep.refobjid
+		LEFT JOIN pg_proc p ON dep.refclassid = 'pg_proc'::regclass AND p.oid = dep.refobjid
+		JOIN pg_namespace rn ON rn.oid = coalesce(r.relnamespace, p.pronamespace)
+		WHERE %s`, namespaceFilter))
+	if err != nil {
+		return fmt.Errorf("failed to query dependencies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, schemaName, name, member, refSchema, refName, refArgs string
+		var function bool
+		err = rows.Scan(&kind, &schemaName, &name, &member, &refSchema, &refName, &function, &refArgs)
+		if err != nil {
+			return fmt.Errorf("failed to scan dependency: %w", err)
+		}
+
+		key := qualifiedName(schemaName, name)
+		refKey := qualifiedName(refSchema, refName)
+		if function {
+			refKey = functionKey(refSchema, refName, refArgs)
+		}
+		switch kind {
+		case "view":
+			if v, ok := s.Views[key]; ok {
+				v.Dependencies = append(v.Dependencies, refKey)
+			}
+		case "trigger":
+			if t, ok := s.Tables[key]; ok && t.Triggers[member] != nil {
+				t.Triggers[member].Dependencies = append(t.Triggers[member].Dependencies, refKey)
+			}
+		case "default":
+			if t, ok := s.Tables[key]; ok {
+				for _, c := range t.Columns {
+					if c.Name == member {
+						c.DefaultDependencies = append(c.DefaultDependencies, refKey)
+					}
+				}
+			}
+		}
+	}
+
+	//nolint:wrapcheck
+	return rows.Err()
+}
+
+func defaultACLKey(role, schema, objectType string) string {
+	return quoteIdent(role) + "." + quoteIdent(schema) + "." + objectType
+}
+
+func inspectDefaultACLs(ctx context.Context, tx pgx.Tx, s *Schema) error {
+	// Entries without a schema replace the built-in default privileges, entries with a schema are added to them.
+	// acldefault uses s instead of S for sequences.
+	for _, q := range []struct {
+		acl       string
+		isDefault bool
+	}{
+		{acl: "d.defaclacl", isDefault: false},
+		{acl: `CASE WHEN d.defaclnamespace = 0
+			THEN acldefault(CASE d.defaclobjtype WHEN 'S' THEN 's'::"char" ELSE d.defaclobjtype END, d.defaclrole)
+			ELSE '{}'::aclitem[] END`, isDefault: true},
+	} {
+		rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT pg_get_userbyid(d.defaclrole), coalesce(n.nspname, ''),
+				d.defaclobjtype::text, coalesce(r.rolname, 'PUBLIC'), a.privilege_type, a.is_grantable
+			FROM pg_default_acl d
+			LEFT JOIN pg_namespace n ON n.oid = d.defaclnamespace,
+			aclexplode(%s) a
+			LEFT JOIN pg_roles r ON r.oid = a.grantee`, q.acl))
+		if err != nil {
+			return fmt.Errorf("failed to query default privileges: %w", err)
+		}
+
+		for rows.Next() {
+			acl := &DefaultACL{}
+			var p Privilege
+			err = rows.Scan(&acl.Role, &acl.Schema, &acl.ObjectType, &p.Grantee, &p.Type, &p.Grantable)
+			if err != nil {
+				rows.Close()
+
+				return fmt.Errorf("failed to scan default privilege: %w", err)
+			}
+
+			k := defaultACLKey(acl.Role, acl.Schema, acl.ObjectType)
+			if existing, ok := s.DefaultACLs[k]; ok {
+				acl = existing
+			} else {
+				s.DefaultACLs[k] = acl
+			}
+			if q.isDefault {
+				acl.DefaultPrivileges = append(acl.DefaultPrivileges, p)
+			} else {
+				acl.Privileges = append(acl.Privileges, p)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("failed to query default privileges: %w", err)
+		}
+	}
+
+	return nil
+}
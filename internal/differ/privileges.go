@@ -0,0 +1,225 @@
+package differ
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func formatGrantee(grantee string) string {
+	if grantee == "PUBLIC" {
+		return "public"
+	}
+
+	return quoteIdent(grantee)
+}
+
+// privilegeStatements returns the statements to change the privileges of an object from one set to another.
+// object is the object as it appears in a GRANT statement, e.g. table "public"."foo".
+func privilegeStatements(object string, from, to []Privilege) []string {
+	fromSet := map[Privilege]struct{}{}
+	for _, p := range from {
+		fromSet[p] = struct{}{}
+	}
+	toSet := map[Privilege]struct{}{}
+	for _, p := range to {
+		toSet[p] = struct{}{}
+	}
+
+	var revokes, grants []string
+	for p := range fromSet {
+		if _, ok := toSet[p]; !ok {
+			revokes = append(revokes, fmt.Sprintf(
+				"revoke %s on %s from %s;", strings.ToLower(p.Type), object, formatGrantee(p.Grantee),
+			))
+		}
+	}
+	for p := range toSet {
+		if _, ok := fromSet[p]; !ok {
+			grantOption := ""
+			if p.Grantable {
+				grantOption = " with grant option"
+			}
+			grants = append(grants, fmt.Sprintf(
+				"grant %s on %s to %s%s;", strings.ToLower(p.Type), object, formatGrantee(p.Grantee), grantOption,
+			))
+		}
+	}
+	sort.Strings(revokes)
+	sort.Strings(grants)
+
+	return append(revokes, grants...)
+}
+
+// changePrivileges compares the privileges of all objects which exist in the to schema. Objects which have been
+// created or recreated start with the default privileges of their owner.
+//
+//nolint:cyclop
+func (d *diff) changePrivileges() {
+	basePrivileges := func(k string, fromPrivileges []Privilege, exists bool, defaultPrivileges []Privilege) []Privilege {
+		if _, ok := d.recreated[k]; ok || !exists {
+			return defaultPrivileges
+		}
+
+		return fromPrivileges
+	}
+
+	for _, k := range sortedKeys(d.to.Namespaces) {
+		n := d.to.Namespaces[k]
+		var fromPrivileges []Privilege
+		fromNamespace, ok := d.from.Namespaces[k]
+		if ok {
+			fromPrivileges = fromNamespace.Privileges
+		}
+		d.statements = append(d.statements, privilegeStatements(
+			"schema "+k, basePrivileges(k, fromPrivileges, ok, n.DefaultPrivileges), n.Privileges,
+		)...)
+	}
+
+	for _, k := range sortedKeys(d.to.Sequences) {
+		q := d.to.Sequences[k]
+		var fromPrivileges []Privilege
+		fromSequence, ok := d.from.Sequences[k]
+		if ok {
+			fromPrivileges = fromSequence.Privileges
+		}
+		d.statements = append(d.statements, privilegeStatements(
+			"sequence "+k, basePrivileges(k, fromPrivileges, ok, q.DefaultPrivileges), q.Privileges,
+		)...)
+	}
+
+	for _, k := range sortedKeys(d.to.Tables) {
+		t := d.to.Tables[k]
+		var fromPrivileges []Privilege
+		fromTable, ok := d.from.Tables[k]
+		if ok {
+			fromPrivileges = fromTable.Privileges
+		}
+		d.statements = append(d.statements, privilegeStatements(
+			"table "+k, basePrivileges(k, fromPrivileges, ok, t.DefaultPrivileges), t.Privileges,
+		)...)
+	}
+
+	for _, k := range sortedKeys(d.to.Views) {
+		v := d.to.Views[k]
+		var fromPrivileges []Privilege
+		fromView, ok := d.from.Views[k]
+		if ok {
+			fromPrivileges = fromView.Privileges
+		}
+		d.statements = append(d.statements, privilegeStatements(
+			"table "+k, basePrivileges(k, fromPrivileges, ok, v.DefaultPrivileges), v.Privileges,
+		)...)
+	}
+
+	for _, k := range sortedKeys(d.to.Functions) {
+		f := d.to.Functions[k]
+		var fromPrivileges []Privilege
+		fromFunction, ok := d.from.Functions[k]
+		if ok {
+			fromPrivileges = fromFunction.Privileges
+		}
+		d.statements = append(d.statements, privilegeStatements(
+			functionKind(f)+" "+k, basePrivileges(k, fromPrivileges, ok, f.DefaultPrivileges), f.Privileges,
+		)...)
+	}
+}
+
+func (d *diff) changeOwner(object, fromOwner, toOwner string) {
+	if fromOwner != toOwner {
+		d.add("alter %s owner to %s;", object, quoteIdent(toOwner))
+	}
+}
+
+// changeOwners changes the owners of the objects which exist in both schemas.
+//
+//nolint:cyclop
+func (d *diff) changeOwners() {
+	for _, k := range sortedKeys(d.to.Namespaces) {
+		if fromNamespace, ok := d.from.Namespaces[k]; ok {
+			d.changeOwner("schema "+k, fromNamespace.Owner, d.to.Namespaces[k].Owner)
+		}
+	}
+	for _, k := range sortedKeys(d.to.Enums) {
+		if fromEnum, ok := d.from.Enums[k]; ok {
+			d.changeOwner("type "+k, fromEnum.Owner, d.to.Enums[k].Owner)
+		}
+	}
+	for _, k := range sortedKeys(d.to.Sequences) {
+		if fromSequence, ok := d.from.Sequences[k]; ok {
+			d.changeOwner("sequence "+k, fromSequence.Owner, d.to.Sequences[k].Owner)
+		}
+	}
+	for _, k := range sortedKeys(d.to.Tables) {
+		if fromTable, ok := d.from.Tables[k]; ok {
+			d.changeOwner("table "+k, fromTable.Owner, d.to.Tables[k].Owner)
+		}
+	}
+	for _, k := range sortedKeys(d.to.Views) {
+		if fromView, ok := d.from.Views[k]; ok {
+			v := d.to.Views[k]
+			d.changeOwner(viewKind(v)+" "+k, fromView.Owner, v.Owner)
+		}
+	}
+	for _, k := range sortedKeys(d.to.Functions) {
+		if fromFunction, ok := d.from.Functions[k]; ok {
+			f := d.to.Functions[k]
+			d.changeOwner(functionKind(f)+" "+k, fromFunction.Owner, f.Owner)
+		}
+	}
+}
+
+func defaultACLObjectType(objectType string) string {
+	switch objectType {
+	case "r":
+		return "tables"
+	case "S":
+		return "sequences"
+	case "f":
+		return "functions"
+	case "T":
+		return "types"
+	case "n":
+		return "schemas"
+	}
+
+	return objectType
+}
+
+// changeDefaultPrivileges compares the privileges set with ALTER DEFAULT PRIVILEGES. A missing entry is equivalent to
+// the default privileges of the entry in the other schema.
+func (d *diff) changeDefaultPrivileges() {
+	keys := sortedKeys(d.to.DefaultACLs)
+	for _, k := range sortedKeys(d.from.DefaultACLs) {
+		if _, ok := d.to.DefaultACLs[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		fromACL, fromOK := d.from.DefaultACLs[k]
+		toACL, toOK := d.to.DefaultACLs[k]
+
+		var fromPrivileges, toPrivileges []Privilege
+		acl := toACL
+		if toOK {
+			toPrivileges = toACL.Privileges
+		} else {
+			acl = fromACL
+			toPrivileges = fromACL.DefaultPrivileges
+		}
+		if fromOK {
+			fromPrivileges = fromACL.Privileges
+		} else {
+			fromPrivileges = toACL.DefaultPrivileges
+		}
+
+		prefix := "alter default privileges for role " + quoteIdent(acl.Role)
+		if acl.Schema != "" {
+			prefix += " in schema " + quoteIdent(acl.Schema)
+		}
+		for _, statement := range privilegeStatements(defaultACLObjectType(acl.ObjectType), fromPrivileges, toPrivileges) {
+			d.add("%s %s", prefix, statement)
+		}
+	}
+}
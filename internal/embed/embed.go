@@ -11,6 +11,9 @@ var DockerComposeYamlTmpl string
 //go:embed Dockerfile.tmpl
 var DockerfileTmpl string
 
+//go:embed schema.sql.tmpl
+var SchemaSQLTmpl string
+
 //go:embed trek.yaml.tmpl
 var TrekYamlTmpl string
 
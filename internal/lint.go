@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LintSeverity decides whether a lint violation fails the check, is only reported or is ignored.
+type LintSeverity string
+
+const (
+	LintSeverityError   LintSeverity = "error"
+	LintSeverityWarning LintSeverity = "warning"
+	LintSeverityOff     LintSeverity = "off"
+)
+
+// LintIgnoreDirective in a comment directly above a statement suppresses the lint rules listed after it, or all rules
+// if none are listed, e.g. "-- trek:lint-ignore non-concurrent-index".
+const LintIgnoreDirective = "-- trek:lint-ignore"
+
+// lintStatement is a normalized statement of a migration together with the state of the migration before it.
+type lintStatement struct {
+	sql   string
+	table string
+	// created are the tables created earlier in the migration, which can't contain rows yet
+	created map[string]bool
+	// validated are the columns, as "table.column", which have a validated check constraint earlier in the migration
+	// that they are not null
+	validated map[string]bool
+}
+
+// LintRule detects statements which take long ACCESS EXCLUSIVE locks on tables with data.
+type LintRule struct {
+	ID          string
+	Description string
+	match       *regexp.Regexp
+	unless      *regexp.Regexp
+	// newTables makes the rule apply to tables created in the same migration, which are usually empty
+	newTables bool
+	// skip allows rules to look at the earlier statements of the migration
+	skip func(s *lintStatement) bool
+}
+
+func (r *LintRule) violatedBy(s *lintStatement) bool {
+	if !r.match.MatchString(s.sql) || (r.unless != nil && r.unless.MatchString(s.sql)) {
+		return false
+	}
+	if !r.newTables && s.created[s.table] {
+		return false
+	}
+
+	return r.skip == nil || !r.skip(s)
+}
+
+// LintRules are the rules checked by LintMigration. All of them report a warning by default.
+//
+//nolint:gochecknoglobals,lll
+var LintRules = newLintRules([]LintRule{
+	{
+		ID:          "volatile-default",
+		Description: "adds a column with a volatile default, which rewrites the table",
+	},
+	{
+		ID:          "non-concurrent-index",
+		Description: "builds an index without concurrently, which blocks writes to the table",
+	},
+	{
+		ID:          "set-not-null",
+		Description: "sets not null without a validated check constraint, which scans the table",
+		skip: func(s *lintStatement) bool {
+			matches := regexpLintSetNotNull.FindAllStringSubmatch(s.sql, -1)
+			for _, match := range matches {
+				if !s.validated[s.table+"."+normalizeLintIdentifier(match[1])] {
+					return false
+				}
+			}
+
+			return len(matches) > 0
+		},
+	},
+	{
+		ID:          "column-type-change",
+		Description: "changes the type of a column, which usually rewrites the table",
+	},
+	{
+		ID:          "foreign-key-not-valid",
+		Description: "adds a foreign key without not valid, which scans the table",
+	},
+	{
+		ID:          "check-not-valid",
+		Description: "adds a check constraint without not valid, which scans the table",
+	},
+	{
+		ID:          "constraint-without-index",
+		Description: "adds a unique or primary key constraint without using index, which builds the index while blocking writes",
+	},
+})
+
+// newLintRules sets the patterns of the rules to the ones of the change rules with their ids, so generate annotates
+// the statements reported by check.
+func newLintRules(rules []LintRule) []LintRule {
+	for i := range rules {
+		for _, c := range changeRules {
+			if c.lint == rules[i].ID {
+				rules[i].match, rules[i].unless = c.match, c.unless
+			}
+		}
+		if rules[i].match == nil {
+			panic(fmt.Sprintf("lint rule %q has no change rule", rules[i].ID))
+		}
+	}
+
+	return rules
+}
+
+//nolint:gochecknoglobals
+var (
+	lintIdentifier         = `((?:"[^"]*"|[a-z_][a-z0-9_$]*)(?:\.(?:"[^"]*"|[a-z_][a-z0-9_$]*))?)`
+	regexpLintCreateTable  = regexp.MustCompile(`^create (?:(?:global |local )?(?:temporary |temp |unlogged ))?table (?:if not exists )?` + lintIdentifier)
+	regexpLintAlterTable   = regexp.MustCompile(`^alter table (?:if exists )?(?:only )?` + lintIdentifier)
+	regexpLintCreateIndex  = regexp.MustCompile(`^create (?:unique )?index\b.*?\bon (?:only )?` + lintIdentifier)
+	lintColumn             = `(` + identifierPattern + `)`
+	regexpLintSetNotNull   = regexp.MustCompile(`\balter (?:column )?` + lintColumn + ` set not null\b`)
+	regexpLintNotNullCheck = regexp.MustCompile(`\badd (?:constraint ` + lintColumn + ` )?check ?\(+ ?` + lintColumn + ` is not null ?\)+`)
+	regexpLintValidate     = regexp.MustCompile(`\bvalidate constraint ` + lintColumn)
+	regexpLintNotValid     = regexp.MustCompile(`\bnot valid\b`)
+)
+
+// LintViolation is a statement of a migration which violates a lint rule.
+type LintViolation struct {
+	File     string
+	Line     int
+	Rule     string
+	Severity LintSeverity
+	Message  string
+}
+
+func (v *LintViolation) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", v.File, v.Line, v.Severity, v.Message, v.Rule)
+}
+
+// IsLintRule returns whether a rule with the id exists.
+func IsLintRule(id string) bool {
+	for _, rule := range LintRules {
+		if rule.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LintMigration returns the violations of the lint rules by the statements of the migration file. severities
+// overrides the default severity of the rules by their id.
+func LintMigration(file, sql string, severities map[string]LintSeverity) []LintViolation {
+	lines := strings.Split(sql, "\n")
+	created := map[string]bool{}
+	validated := map[string]bool{}
+	// notValidChecks are the columns of the not null check constraints added with not valid, by "table.constraint"
+	notValidChecks := map[string]string{}
+
+	var violations []LintViolation
+	for _, statement := range SplitStatements(sql) {
+		s := &lintStatement{
+			sql:       strings.ToLower(regexpWhitespace.ReplaceAllString(strings.TrimSpace(statement.SQL), " ")),
+			created:   created,
+			validated: validated,
+		}
+		for _, r := range []*regexp.Regexp{regexpLintAlterTable, regexpLintCreateIndex} {
+			if match := r.FindStringSubmatch(s.sql); match != nil {
+				s.table = normalizeLintTable(match[1])
+
+				break
+			}
+		}
+
+		ignored, ignoreAll := lintIgnoredRules(lines, statement.Line)
+		for i := range LintRules {
+			rule := &LintRules[i]
+			severity := LintSeverityWarning
+			if configured, ok := severities[rule.ID]; ok {
+				severity = configured
+			}
+			if severity == LintSeverityOff || ignoreAll || ignored[rule.ID] || !rule.violatedBy(s) {
+				continue
+			}
+			violations = append(violations, LintViolation{
+				File:     file,
+				Line:     statement.Line,
+				Rule:     rule.ID,
+				Severity: severity,
+				Message:  rule.Description,
+			})
+		}
+
+		if match := regexpLintCreateTable.FindStringSubmatch(s.sql); match != nil {
+			created[normalizeLintTable(match[1])] = true
+		}
+		if s.table != "" {
+			notValid := regexpLintNotValid.MatchString(s.sql)
+			for _, match := range regexpLintNotNullCheck.FindAllStringSubmatch(s.sql, -1) {
+				column := s.table + "." + normalizeLintIdentifier(match[2])
+				if !notValid {
+					validated[column] = true
+				} else if match[1] != "" {
+					notValidChecks[s.table+"."+normalizeLintIdentifier(match[1])] = column
+				}
+			}
+			for _, match := range regexpLintValidate.FindAllStringSubmatch(s.sql, -1) {
+				if column, ok := notValidChecks[s.table+"."+normalizeLintIdentifier(match[1])]; ok {
+					validated[column] = true
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+// lintIgnoredRules returns the rules suppressed by the comments directly above the statement on the 1-based line.
+func lintIgnoredRules(lines []string, line int) (ignored map[string]bool, all bool) {
+	ignored = map[string]bool{}
+	for i := line - 2; i >= 0 && i < len(lines); i-- {
+		comment := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(comment, "--") {
+			break
+		}
+		if !strings.HasPrefix(comment, LintIgnoreDirective) {
+			continue
+		}
+		rules := strings.Fields(strings.ReplaceAll(strings.TrimPrefix(comment, LintIgnoreDirective), ",", " "))
+		if len(rules) == 0 {
+			all = true
+		}
+		for _, rule := range rules {
+			ignored[rule] = true
+		}
+	}
+
+	return ignored, all
+}
+
+// normalizeLintTable returns the table name without quotes and the public schema.
+func normalizeLintTable(name string) string {
+	return strings.TrimPrefix(normalizeLintIdentifier(name), "public.")
+}
+
+// normalizeLintIdentifier returns the identifier without quotes.
+func normalizeLintIdentifier(name string) string {
+	return strings.ReplaceAll(name, `"`, "")
+}
@@ -0,0 +1,198 @@
+package internal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestLintMigration(t *testing.T) {
+	t.Parallel()
+
+	// violation is a rule violated by the statement on the line
+	type violation struct {
+		line int
+		rule string
+	}
+
+	tests := []struct {
+		name       string
+		sql        string
+		severities map[string]internal.LintSeverity
+		want       []violation
+	}{
+		{
+			name: "volatile default",
+			sql:  "ALTER TABLE users ADD COLUMN id uuid DEFAULT gen_random_uuid();",
+			want: []violation{{1, "volatile-default"}},
+		},
+		{
+			name: "stable default",
+			sql:  "ALTER TABLE users ADD COLUMN created_at timestamptz DEFAULT now();",
+			want: nil,
+		},
+		{
+			name: "non-concurrent index",
+			sql:  "SELECT 1;\nCREATE INDEX users_name ON users (name);\nCREATE INDEX CONCURRENTLY users_email ON users (email);",
+			want: []violation{{2, "non-concurrent-index"}},
+		},
+		{
+			name: "foreign key and check",
+			sql: "ALTER TABLE orders ADD CONSTRAINT orders_user FOREIGN KEY (user_id) REFERENCES users (id);\n" +
+				"ALTER TABLE orders ADD CONSTRAINT orders_amount CHECK (amount > 0) NOT VALID;",
+			want: []violation{{1, "foreign-key-not-valid"}},
+		},
+		{
+			name: "column type change and constraint without index",
+			sql: "ALTER TABLE users ALTER COLUMN name TYPE text;\n" +
+				"ALTER TABLE users ADD CONSTRAINT users_email UNIQUE (email);\n" +
+				"ALTER TABLE users ADD CONSTRAINT users_name UNIQUE USING INDEX users_name;",
+			want: []violation{{1, "column-type-change"}, {2, "constraint-without-index"}},
+		},
+		{
+			name: "column named type",
+			sql:  "ALTER TABLE items ALTER COLUMN \"type\" SET DEFAULT 'a';\nALTER TABLE items ALTER COLUMN type TYPE text;",
+			want: []violation{{2, "column-type-change"}},
+		},
+		{
+			name: "set not null",
+			sql:  "ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: []violation{{1, "set-not-null"}},
+		},
+		{
+			name: "set not null after validated not null check",
+			sql: "ALTER TABLE users ADD CONSTRAINT users_name CHECK ((name IS NOT NULL)) NOT VALID;\n" +
+				"ALTER TABLE users VALIDATE CONSTRAINT users_name;\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: nil,
+		},
+		{
+			name: "set not null after check which isn't validated",
+			sql: "ALTER TABLE users ADD CONSTRAINT users_name CHECK (name IS NOT NULL) NOT VALID;\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: []violation{{2, "set-not-null"}},
+		},
+		{
+			name: "set not null after validated check of another column",
+			sql: "ALTER TABLE users ADD CONSTRAINT users_email CHECK (email IS NOT NULL) NOT VALID;\n" +
+				"ALTER TABLE users VALIDATE CONSTRAINT users_email;\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: []violation{{3, "set-not-null"}},
+		},
+		{
+			name: "set not null after validated check of another table",
+			sql: "ALTER TABLE orders ADD CONSTRAINT orders_name CHECK (name IS NOT NULL) NOT VALID;\n" +
+				"ALTER TABLE orders VALIDATE CONSTRAINT orders_name;\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: []violation{{3, "set-not-null"}},
+		},
+		{
+			name: "set not null after other validated constraint",
+			sql: "ALTER TABLE users ADD CONSTRAINT users_age CHECK (age > 0) NOT VALID;\n" +
+				"ALTER TABLE users VALIDATE CONSTRAINT users_age;\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: []violation{{3, "set-not-null"}},
+		},
+		{
+			name: "quoted identifiers",
+			sql: "ALTER TABLE \"public\".\"users\" ADD CONSTRAINT \"users_name\" CHECK ((\"name\" IS NOT NULL)) NOT VALID;\n" +
+				"ALTER TABLE public.users VALIDATE CONSTRAINT users_name;\n" +
+				"ALTER TABLE \"users\" ALTER COLUMN \"name\" SET NOT NULL;",
+			want: nil,
+		},
+		{
+			name: "tables created in the same migration",
+			sql: "CREATE TABLE \"public\".\"users\" (id int);\n" +
+				"ALTER TABLE users ALTER COLUMN id SET NOT NULL;\n" +
+				"CREATE INDEX users_id ON public.users (id);\n" +
+				"ALTER TABLE \"users\" ADD COLUMN token uuid DEFAULT gen_random_uuid();\n" +
+				"ALTER TABLE orders ADD COLUMN token uuid DEFAULT gen_random_uuid();",
+			want: []violation{{5, "volatile-default"}},
+		},
+		{
+			name: "ignore directive for a rule",
+			sql: "-- trek:lint-ignore set-not-null\n" +
+				"ALTER TABLE users ALTER COLUMN name SET NOT NULL;\n" +
+				"-- trek:lint-ignore set-not-null\n" +
+				"ALTER TABLE users ALTER COLUMN name TYPE text;",
+			want: []violation{{4, "column-type-change"}},
+		},
+		{
+			name: "ignore directive for multiple rules",
+			sql: "-- trek:lint-ignore non-concurrent-index, column-type-change\n" +
+				"-- explains why\n" +
+				"CREATE INDEX users_name ON users (name);",
+			want: nil,
+		},
+		{
+			name: "ignore directive for all rules",
+			sql:  "-- trek:lint-ignore\nALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			want: nil,
+		},
+		{
+			name: "ignore directive separated by a statement",
+			sql:  "-- trek:lint-ignore\nSELECT 1;\nCREATE INDEX users_name ON users (name);",
+			want: []violation{{3, "non-concurrent-index"}},
+		},
+		{
+			name:       "rule turned off",
+			sql:        "CREATE INDEX users_name ON users (name);\nALTER TABLE users ALTER COLUMN name SET NOT NULL;",
+			severities: map[string]internal.LintSeverity{"non-concurrent-index": internal.LintSeverityOff},
+			want:       []violation{{2, "set-not-null"}},
+		},
+		{
+			name: "statements in dollar quotes",
+			sql:  "DO $$ BEGIN EXECUTE 'CREATE INDEX users_name ON users (name)'; END $$;",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got []violation
+			for _, v := range internal.LintMigration("001_test.up.sql", tt.sql, tt.severities) {
+				got = append(got, violation{v.Line, v.Rule})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LintMigration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintMigrationSeverity(t *testing.T) {
+	t.Parallel()
+
+	sql := "CREATE INDEX users_name ON users (name);"
+	tests := []struct {
+		name       string
+		severities map[string]internal.LintSeverity
+		want       internal.LintSeverity
+	}{
+		{
+			name: "default",
+			want: internal.LintSeverityWarning,
+		},
+		{
+			name:       "configured",
+			severities: map[string]internal.LintSeverity{"non-concurrent-index": internal.LintSeverityError},
+			want:       internal.LintSeverityError,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			violations := internal.LintMigration("001_test.up.sql", sql, tt.severities)
+			if len(violations) != 1 || violations[0].Severity != tt.want {
+				t.Errorf("LintMigration() = %v, want a violation with severity %q", violations, tt.want)
+			}
+		})
+	}
+}
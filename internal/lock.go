@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+const lockPollInterval = 500 * time.Millisecond
+
+// LockHolder describes the session holding an advisory lock.
+type LockHolder struct {
+	PID             int32
+	User            string
+	ApplicationName string
+	ClientAddress   string
+	BackendStart    time.Time
+}
+
+func (h *LockHolder) String() string {
+	s := fmt.Sprintf("pid %d of user %q", h.PID, h.User)
+	if h.ApplicationName != "" {
+		s += fmt.Sprintf(" (%s)", h.ApplicationName)
+	}
+	if h.ClientAddress != "" {
+		s += fmt.Sprintf(" from %s", h.ClientAddress)
+	}
+
+	return s + fmt.Sprintf(" connected since %s", h.BackendStart.Format(time.RFC3339))
+}
+
+// AdvisoryLockKey returns the key of the advisory lock for the name.
+func AdvisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("trek:" + name))
+
+	//nolint:gosec
+	return int64(h.Sum64())
+}
+
+// AcquireAdvisoryLock takes the session-level advisory lock with the key on the connection. Advisory locks are scoped
+// to a database, so everyone who competes for the lock has to connect to the same database. While the lock is held by
+// another session, the holder is logged and AcquireAdvisoryLock waits until the lock is free or timeout has passed.
+// The returned function releases the lock.
+func AcquireAdvisoryLock(
+	ctx context.Context,
+	conn *pgx.Conn,
+	key int64,
+	timeout time.Duration,
+) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	var lastHolder *LockHolder
+
+	for {
+		var acquired bool
+		err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+		if acquired {
+			return func() {
+				_, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+				if err != nil {
+					log.Printf("Failed to release advisory lock: %v\n", err)
+				}
+			}, nil
+		}
+
+		holder, err := getAdvisoryLockHolder(ctx, conn, key)
+		if err != nil {
+			return nil, err
+		}
+		if holder != nil && (lastHolder == nil || holder.PID != lastHolder.PID) {
+			log.Printf("Waiting for the lock held by %s\n", holder)
+		}
+		if holder != nil {
+			lastHolder = holder
+		}
+
+		if time.Now().After(deadline) {
+			if lastHolder != nil {
+				return nil, fmt.Errorf("%w after %s, it is held by %s", ErrLockTimeout, timeout, lastHolder)
+			}
+
+			return nil, fmt.Errorf("%w after %s", ErrLockTimeout, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to acquire advisory lock: %w", ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// getAdvisoryLockHolder returns the session holding the advisory lock, or nil if it isn't held or the holder isn't
+// visible to the user. The 64-bit key is split into classid and objid by PostgreSQL.
+func getAdvisoryLockHolder(ctx context.Context, conn *pgx.Conn, key int64) (*LockHolder, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT a.pid, coalesce(a.usename, ''), coalesce(a.application_name, ''), coalesce(host(a.client_addr), ''),
+			a.backend_start
+		FROM pg_catalog.pg_locks l
+		JOIN pg_catalog.pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND l.classid::bigint = ($1::bigint >> 32) & 4294967295 AND l.objid::bigint = $1::bigint & 4294967295
+			AND l.objsubid = 1`,
+		key,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query advisory lock holder: %w", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		//nolint:wrapcheck
+		return nil, rows.Err()
+	}
+
+	var holder LockHolder
+	err = rows.Scan(
+		&holder.PID,
+		&holder.User,
+		&holder.ApplicationName,
+		&holder.ClientAddress,
+		&holder.BackendStart,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan advisory lock holder: %w", err)
+	}
+
+	return &holder, nil
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	// needed driver.
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// NewMigrate returns a go-migrate instance for the database of the config. The database is opened with pgx, so all
+// settings of the config are supported. Every migration runs in a transaction, unless it contains the
+// NoTransactionDirective or controls its transactions itself. The returned function closes the instance.
+func NewMigrate(migrationsDir string, config *pgx.ConnConfig) (*migrate.Migrate, func(), error) {
+	db := stdlib.OpenDB(*config)
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		_ = db.Close()
+
+		return nil, nil, fmt.Errorf("failed to initialize go-migrate: %w", err)
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(
+		fmt.Sprintf("file://%s", migrationsDir),
+		"postgres",
+		&transactionDriver{Driver: driver},
+	)
+	if err != nil {
+		_ = driver.Close()
+		_ = db.Close()
+
+		return nil, nil, fmt.Errorf("failed to initialize go-migrate: %w", err)
+	}
+
+	return m, func() {
+		_, _ = m.Close()
+		_ = db.Close()
+	}, nil
+}
+
+// NewMigrateFromDSN is like NewMigrate for the database of the DSN.
+func NewMigrateFromDSN(migrationsDir, dsn string) (*migrate.Migrate, func(), error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+
+	return NewMigrate(migrationsDir, config)
+}
+
+// transactionDriver controls the transactions of the migrations run by the postgres driver, which executes a whole
+// migration file at once.
+type transactionDriver struct {
+	database.Driver
+}
+
+func (d *transactionDriver) Run(migration io.Reader) error {
+	data, err := io.ReadAll(migration)
+	if err != nil {
+		return fmt.Errorf("failed to read migration: %w", err)
+	}
+	sql := string(data)
+
+	if HasNoTransactionDirective(sql) {
+		for _, s := range SplitStatements(sql) {
+			err = d.Driver.Run(strings.NewReader(s.SQL))
+			if err != nil {
+				//nolint:wrapcheck
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// The statements are sent in one message, so the transaction ends at the first failing statement. Wrapping a
+	// migration which controls its transactions itself would commit in the middle of it, so it is executed as it is
+	if !HasTransactionControl(sql) {
+		sql = "BEGIN;\n" + sql + "\n;\nCOMMIT;"
+	}
+	err = d.Driver.Run(strings.NewReader(sql))
+	if err != nil {
+		_ = d.Driver.Run(strings.NewReader("ROLLBACK;"))
+
+		//nolint:wrapcheck
+		return err
+	}
+
+	return nil
+}
@@ -1,20 +1,30 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/manifoldco/promptui"
 )
 
 const regexpPartialLowerKebabCase = `[a-z][a-z0-9\-]*[a-z]`
 
+const (
+	migrationFileSuffixUp   = ".up.sql"
+	migrationFileSuffixDown = ".down.sql"
+)
+
 var (
-	RegexpMigrationName     = regexp.MustCompile(`^` + regexpPartialLowerKebabCase + `$`)
-	RegexpMigrationFileName = regexp.MustCompile(`^\d{3}_` + regexpPartialLowerKebabCase + `\.up\.sql$`)
+	RegexpMigrationName         = regexp.MustCompile(`^` + regexpPartialLowerKebabCase + `$`)
+	RegexpMigrationFileName     = regexp.MustCompile(`^\d{3}_` + regexpPartialLowerKebabCase + `\.(up|down)\.sql$`)
+	RegexpUpMigrationFileName   = regexp.MustCompile(`^\d{3}_` + regexpPartialLowerKebabCase + `\.up\.sql$`)
+	RegexpDownMigrationFileName = regexp.MustCompile(`^\d{3}_` + regexpPartialLowerKebabCase + `\.down\.sql$`)
 )
 
 func GetMigrationsDir(wd string) (string, error) {
@@ -30,12 +40,40 @@ func GetMigrationsDir(wd string) (string, error) {
 }
 
 func GetMigrationFileName(migrationNumber uint, migrationName string) string {
-	return fmt.Sprintf("%03d_%s.up.sql", migrationNumber, migrationName)
+	return fmt.Sprintf("%03d_%s%s", migrationNumber, migrationName, migrationFileSuffixUp)
+}
+
+// GetDownMigrationFileName returns the name of the down migration belonging to the up migration file name.
+func GetDownMigrationFileName(upMigrationFileName string) string {
+	return strings.TrimSuffix(upMigrationFileName, migrationFileSuffixUp) + migrationFileSuffixDown
+}
+
+// GetMigrationNumber returns the number of the migration file name, or 0 if it isn't a migration file name.
+func GetMigrationNumber(fileName string) uint {
+	if !RegexpMigrationFileName.MatchString(fileName) {
+		return 0
+	}
+	number, err := strconv.ParseUint(fileName[:3], 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return uint(number)
+}
+
+// GetMigrationName returns the name of the migration file name without its number and suffix.
+func GetMigrationName(fileName string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(fileName, migrationFileSuffixUp), migrationFileSuffixDown)
+	if i := strings.Index(name, "_"); i >= 0 {
+		return name[i+1:]
+	}
+
+	return name
 }
 
 func GetNewMigrationFilePath(
 	migrationsDir string,
-	migrationsCount uint,
+	latestVersion uint,
 	migrationName string,
 	overwrite bool,
 ) (
@@ -45,10 +83,10 @@ func GetNewMigrationFilePath(
 ) {
 	var migrationsNumber uint
 	if _, err = os.Stat(
-		filepath.Join(migrationsDir, GetMigrationFileName(migrationsCount, migrationName)),
+		filepath.Join(migrationsDir, GetMigrationFileName(latestVersion, migrationName)),
 	); err == nil {
 		if overwrite {
-			migrationsNumber = migrationsCount
+			migrationsNumber = latestVersion
 		} else {
 			prompt := promptui.Prompt{
 				//nolint:lll
@@ -57,20 +95,23 @@ func GetNewMigrationFilePath(
 				Default:   "y",
 			}
 			if _, err = prompt.Run(); err == nil {
-				migrationsNumber = migrationsCount
+				migrationsNumber = latestVersion
 			} else {
-				migrationsNumber = migrationsCount + 1
+				migrationsNumber = latestVersion + 1
 			}
 		}
 	} else {
-		migrationsNumber = migrationsCount + 1
+		migrationsNumber = latestVersion + 1
 	}
 
 	return filepath.Join(migrationsDir, GetMigrationFileName(migrationsNumber, migrationName)), migrationsNumber, nil
 }
 
+// FindMigrations returns the names of the up migration files in migrationsDir.
+// Down migrations are optional, but in strict mode every down migration needs a matching up migration.
 func FindMigrations(migrationsDir string, strict bool) ([]string, error) {
 	var files []string
+	var downFiles []string
 
 	err := filepath.WalkDir(migrationsDir, func(path string, d fs.DirEntry, err error) error {
 		if path == migrationsDir {
@@ -87,11 +128,63 @@ func FindMigrations(migrationsDir string, strict bool) ([]string, error) {
 			}
 		}
 
-		files = append(files, d.Name())
+		if strings.HasSuffix(d.Name(), migrationFileSuffixDown) {
+			downFiles = append(downFiles, d.Name())
+		} else {
+			files = append(files, d.Name())
+		}
 
 		return nil
 	})
+	if err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	if strict {
+		expectedDownFiles := map[string]struct{}{}
+		for _, file := range files {
+			expectedDownFiles[GetDownMigrationFileName(file)] = struct{}{}
+		}
+		for _, file := range downFiles {
+			if _, ok := expectedDownFiles[file]; !ok {
+				//nolint:goerr113
+				return nil, fmt.Errorf("down migration %q has no matching up migration", file)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// HasDownMigration returns whether a down migration exists for the up migration file.
+func HasDownMigration(migrationsDir, upMigrationFileName string) (bool, error) {
+	_, err := os.Stat(filepath.Join(migrationsDir, GetDownMigrationFileName(upMigrationFileName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat down migration: %w", err)
+	}
+
+	return true, nil
+}
+
+// GetFirstMigrationVersion returns the version of the first up migration file. It is 1, unless older migrations have
+// been squashed into a baseline, which has the version of the newest squashed migration. The versions of the
+// following migrations are consecutive.
+func GetFirstMigrationVersion(files []string) uint {
+	if len(files) == 0 {
+		return 1
+	}
+
+	return GetMigrationNumber(files[0])
+}
+
+// GetLatestMigrationVersion returns the version of the last up migration file, or 0 if there are none.
+func GetLatestMigrationVersion(files []string) uint {
+	if len(files) == 0 {
+		return 0
+	}
 
-	//nolint:wrapcheck
-	return files, err
+	return GetMigrationNumber(files[len(files)-1])
 }
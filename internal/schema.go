@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SchemaSourcePgModeler = "pgmodeler"
+	SchemaSourceSQL       = "sql"
+
+	defaultSchemaDir = "schema"
+)
+
+// UsesPgModeler returns whether the target schema is defined by a pgModeler model.
+func (c *Config) UsesPgModeler() bool {
+	return c.SchemaSource == "" || c.SchemaSource == SchemaSourcePgModeler
+}
+
+// GetSchemaDir returns the directory of the declarative SQL files.
+func (c *Config) GetSchemaDir(wd string) string {
+	if c.SchemaDir != "" {
+		return filepath.Join(wd, c.SchemaDir)
+	}
+
+	return filepath.Join(wd, defaultSchemaDir)
+}
+
+// FindSchemaFiles returns the paths of the SQL files in the schema directory, in lexical order.
+func FindSchemaFiles(schemaDir string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(schemaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".sql") {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find schema files: %w", err)
+	}
+
+	return files, nil
+}
+
+// ReadSchemaSQL returns the SQL which creates the target schema. For pgModeler this is the exported model, for plain
+// SQL the concatenated schema files.
+func ReadSchemaSQL(config *Config, wd string) (string, error) {
+	if config.UsesPgModeler() {
+		data, err := os.ReadFile(filepath.Join(wd, fmt.Sprintf("%s.sql", config.ModelName)))
+		if err != nil {
+			return "", fmt.Errorf("failed to read sql file: %w", err)
+		}
+
+		return string(data), nil
+	}
+
+	files, err := FindSchemaFiles(config.GetSchemaDir(wd))
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read schema file %q: %w", file, err)
+		}
+		parts = append(parts, strings.TrimSuffix(string(data), "\n"))
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+
+	return strings.Join(parts, "\n\n") + "\n", nil
+}
+
+// ReadSchemaSource returns the content of the files defining the target schema, which is used to detect changes.
+func ReadSchemaSource(config *Config, wd string) (string, error) {
+	if config.UsesPgModeler() {
+		data, err := os.ReadFile(filepath.Join(wd, fmt.Sprintf("%s.dbm", config.ModelName)))
+		if err != nil {
+			return "", fmt.Errorf("failed to read model file: %w", err)
+		}
+
+		return string(data), nil
+	}
+
+	return ReadSchemaSQL(config, wd)
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var errUnsupportedMetaCommand = errors.New("unsupported meta-command")
+
+var (
+	regexpMetaCopy      = regexp.MustCompile(`(?is)^(.+?)\s+from\s+('(?:[^']|'')*'|\S+)(.*)$`)
+	regexpCopyFromStdin = regexp.MustCompile(`(?is)^copy\b.*\bfrom\s+stdin\b`)
+)
+
+// scriptCommand is either SQL or a psql meta-command of a SQL file.
+type scriptCommand struct {
+	file string
+	line int
+	sql  string
+	// copy is the COPY statement and source of a \copy meta-command
+	copyStatement string
+	copySource    string
+	// include is the parsed file of a \i or \ir meta-command
+	include []scriptCommand
+}
+
+// ExecuteSQLFile executes the SQL file on the database of the DSN without needing psql. It supports the psql
+// meta-commands \copy ... from, \i and \ir, which are common in testdata. Files using other meta-commands are
+// executed with psql.
+func ExecuteSQLFile(ctx context.Context, dsn, file string) error {
+	commands, err := parseSQLFile(file, nil)
+	if errors.Is(err, errUnsupportedMetaCommand) {
+		log.Printf("Using psql for %q: %v\n", filepath.Base(file), err)
+
+		return PsqlFile(dsn, file)
+	} else if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	return executeScriptCommands(ctx, conn, commands)
+}
+
+func executeScriptCommands(ctx context.Context, conn *pgx.Conn, commands []scriptCommand) error {
+	for _, c := range commands {
+		var err error
+		switch {
+		case c.include != nil:
+			err = executeScriptCommands(ctx, conn, c.include)
+		case c.copyStatement != "":
+			err = executeCopy(ctx, conn, c.copyStatement, c.copySource)
+		default:
+			_, err = conn.Exec(ctx, c.sql)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to execute %s:%d: %w", c.file, c.line, err)
+		}
+	}
+
+	return nil
+}
+
+func executeCopy(ctx context.Context, conn *pgx.Conn, statement, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open copy source: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = conn.PgConn().CopyFrom(ctx, f, statement)
+	if err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+
+	return nil
+}
+
+// parseSQLFile splits the file into SQL and meta-commands. A meta-command starts with a backslash outside of quotes
+// and comments and ends at the end of the line, like in psql. parents are the files including this one, to detect
+// include cycles.
+//
+//nolint:gocognit,cyclop
+func parseSQLFile(file string, parents []string) ([]scriptCommand, error) {
+	for _, p := range parents {
+		if p == file {
+			//nolint:goerr113
+			return nil, fmt.Errorf("%q includes itself", file)
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sql file: %w", err)
+	}
+
+	var (
+		commands  []scriptCommand
+		runes     = []rune(string(data))
+		start     = 0
+		startLine = 1
+		line      = 1
+	)
+
+	// Every statement is executed on its own, so statements are committed one by one like with the autocommit of psql
+	flushSQL := func(end int) error {
+		statements := SplitStatements(string(runes[start:end]))
+		for _, s := range statements {
+			if regexpCopyFromStdin.MatchString(s.SQL) {
+				return fmt.Errorf("%w: COPY FROM STDIN", errUnsupportedMetaCommand)
+			}
+		}
+		for _, s := range statements {
+			commands = append(commands, scriptCommand{file: file, line: startLine + s.Line - 1, sql: s.SQL})
+		}
+
+		return nil
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case r == '\n':
+			line++
+		case r == '-' && next == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			if i < len(runes) {
+				line++
+			}
+		case r == '/' && next == '*':
+			depth := 0
+			for ; i < len(runes); i++ {
+				if runes[i] == '\n' {
+					line++
+				} else if runes[i] == '/' && i+1 < len(runes) && runes[i+1] == '*' {
+					depth++
+					i++
+				} else if runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case r == '\'' || r == '"':
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\n' {
+					line++
+				} else if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case r == '$':
+			tag, ok := dollarQuoteTag(runes[i:])
+			if !ok {
+				continue
+			}
+			end := indexRunes(runes[i+len(tag):], tag)
+			if end < 0 {
+				end = len(runes) - i - len(tag)
+			}
+			line += strings.Count(string(runes[i+len(tag):i+len(tag)+end]), "\n")
+			i += len(tag) + end + len(tag) - 1
+		case r == '\\':
+			err = flushSQL(i)
+			if err != nil {
+				return nil, err
+			}
+
+			end := i
+			for end < len(runes) && runes[end] != '\n' {
+				end++
+			}
+			includeParents := append(append([]string{}, parents...), file)
+			command, err := parseMetaCommand(file, line, string(runes[i+1:end]), includeParents)
+			if err != nil {
+				return nil, err
+			}
+			commands = append(commands, command)
+
+			i = end
+			if i < len(runes) {
+				line++
+			}
+			start = i + 1
+			startLine = line
+		}
+	}
+	if start < len(runes) {
+		err = flushSQL(len(runes))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return commands, nil
+}
+
+func parseMetaCommand(file string, line int, text string, parents []string) (scriptCommand, error) {
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	args = strings.TrimSuffix(strings.TrimSpace(args), ";")
+
+	command := scriptCommand{file: file, line: line}
+
+	switch name {
+	case "copy":
+		match := regexpMetaCopy.FindStringSubmatch(args)
+		if match == nil || strings.HasPrefix(args, "(") {
+			return command, fmt.Errorf("%w: \\copy %s", errUnsupportedMetaCommand, args)
+		}
+		source := unquoteMetaArgument(match[2])
+		if lower := strings.ToLower(source); lower == "stdin" || lower == "pstdin" || strings.HasPrefix(lower, "program") {
+			return command, fmt.Errorf("%w: \\copy from %s", errUnsupportedMetaCommand, source)
+		}
+		command.copyStatement = fmt.Sprintf("COPY %s FROM STDIN%s", match[1], match[3])
+		command.copySource = source
+
+		return command, nil
+	case "i", "include", "ir", "include_relative":
+		include := unquoteMetaArgument(args)
+		if (name == "ir" || name == "include_relative") && !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		commands, err := parseSQLFile(include, parents)
+		if err != nil {
+			return command, err
+		}
+		// An empty slice marks the command as include even if the file contains nothing
+		if commands == nil {
+			commands = []scriptCommand{}
+		}
+		command.include = commands
+
+		return command, nil
+	default:
+		return command, fmt.Errorf("%w: \\%s", errUnsupportedMetaCommand, name)
+	}
+}
+
+func unquoteMetaArgument(argument string) string {
+	if len(argument) >= 2 && strings.HasPrefix(argument, "'") && strings.HasSuffix(argument, "'") {
+		return strings.ReplaceAll(argument[1:len(argument)-1], "''", "'")
+	}
+
+	return argument
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SquashDirective in the first migration file records that the migrations up to its version have been squashed into
+// it, e.g. "-- trek:squashed 42".
+const SquashDirective = "-- trek:squashed"
+
+// BaselineMigrationName is the name of the first migration created by squash and baseline.
+const BaselineMigrationName = "baseline"
+
+var ErrSquashedVersion = errors.New("version has been squashed")
+
+//nolint:gochecknoglobals
+var regexpTestdataIndex = regexp.MustCompile(`^(\d{3})_`)
+
+// GetSquashedVersion returns the version recorded by the SquashDirective of the migration, or 0 if it has none.
+func GetSquashedVersion(sql string) uint {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, SquashDirective+" ") {
+			continue
+		}
+		version, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, SquashDirective)), 10, 32)
+		if err == nil {
+			return uint(version)
+		}
+	}
+
+	return 0
+}
+
+// GetSquashedMigrationVersion returns the version the migrations have been squashed up to, which is recorded by the
+// SquashDirective of the first migration. A baseline split into multiple migrations because of non-transactional
+// statements records the version of its last migration. Without the directive it is the first version.
+func GetSquashedMigrationVersion(migrationsDir string, files []string) (uint, error) {
+	first := GetFirstMigrationVersion(files)
+	if first <= 1 {
+		return first, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(migrationsDir, files[0]))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read migration %q: %w", files[0], err)
+	}
+	if squashed := GetSquashedVersion(string(data)); squashed > first {
+		return squashed, nil
+	}
+
+	return first, nil
+}
+
+// VerifyNotSquashed returns an error if the database version is older than the baseline the migrations have been
+// squashed into, because the migrations between them don't exist anymore.
+func VerifyNotSquashed(version uint, migrationsDir string, files []string) error {
+	squashed, err := GetSquashedMigrationVersion(migrationsDir, files)
+	if err != nil {
+		return err
+	}
+	if version == 0 || version >= squashed {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"%w: database is at version %d, but the migrations up to version %d have been squashed into %q, "+
+			"apply the migrations of a release before the squash first",
+		ErrSquashedVersion,
+		version,
+		squashed,
+		files[0],
+	)
+}
+
+// SquashTestdata renames the testdata files of the migrations up to and including version, in the testdata directory
+// and all sets, to files of the baseline with this version. The original index is kept after the new one, so the
+// files are still inserted in their original order. It returns the new paths.
+func SquashTestdata(testdataDir string, version uint) ([]string, error) {
+	type rename struct {
+		from, to string
+	}
+	var renames []rename
+
+	err := filepath.WalkDir(testdataDir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == testdataDir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		match := regexpTestdataIndex.FindStringSubmatch(d.Name())
+		if match == nil {
+			return nil
+		}
+		index, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil || index == 0 || uint(index) > version {
+			//nolint:nilerr
+			return nil
+		}
+		renames = append(renames, rename{
+			from: p,
+			to:   filepath.Join(filepath.Dir(p), fmt.Sprintf("%03d_%s", version, d.Name())),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find testdata: %w", err)
+	}
+
+	paths := make([]string, 0, len(renames))
+	for _, r := range renames {
+		err = os.Rename(r.from, r.to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rename testdata: %w", err)
+		}
+		paths = append(paths, r.to)
+	}
+
+	return paths, nil
+}
+
+// trimSquashedTestdataIndexes removes the original indexes kept by SquashTestdata from the name of a testdata file
+// without its own index.
+func trimSquashedTestdataIndexes(name string) string {
+	for regexpTestdataIndex.MatchString(name) {
+		name = name[len("000_"):]
+	}
+
+	return name
+}
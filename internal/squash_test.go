@@ -0,0 +1,37 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestGetSquashedVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want uint
+	}{
+		{"directive", "-- trek:squashed 42\nCREATE TABLE users (id int);", 42},
+		{"after other directives", "-- trek:no-transaction\n  -- trek:squashed 7  \nVACUUM users;", 7},
+		{"missing", "CREATE TABLE users (id int);", 0},
+		{"without version", "-- trek:squashed\nCREATE TABLE users (id int);", 0},
+		{"invalid version", "-- trek:squashed abc\nCREATE TABLE users (id int);", 0},
+		{"negative version", "-- trek:squashed -1\nCREATE TABLE users (id int);", 0},
+		{"other directive with the prefix", "-- trek:squashedx 3\nCREATE TABLE users (id int);", 0},
+		{"first valid directive", "-- trek:squashed x\n-- trek:squashed 12\n", 12},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := internal.GetSquashedVersion(tt.sql); got != tt.want {
+				t.Errorf("GetSquashedVersion() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Statement is a single SQL statement of a file.
+type Statement struct {
+	// SQL is the statement including the terminating semicolon, without leading comments and whitespace.
+	SQL string
+	// Line is the 1-based line on which the statement starts.
+	Line int
+}
+
+// SplitStatements splits the SQL into its statements. It understands quoted strings and identifiers, dollar quoting,
+// comments and the BEGIN ATOMIC ... END bodies of SQL functions, so semicolons in those don't end a statement.
+// Comments between statements are dropped.
+//
+//nolint:gocognit,cyclop
+func SplitStatements(sql string) []Statement {
+	var (
+		statements []Statement
+		start      = -1
+		startLine  int
+		line       = 1
+		runes      = []rune(sql)
+		// previousWord, atomicDepth and caseDepth track the BEGIN ATOMIC blocks of the statement like psql, which
+		// end at an END which doesn't belong to a CASE
+		previousWord string
+		atomicDepth  int
+		caseDepth    int
+	)
+
+	flush := func(end int) {
+		if start >= 0 {
+			statements = append(statements, Statement{
+				SQL:  strings.TrimSpace(string(runes[start:end])),
+				Line: startLine,
+			})
+		}
+		start = -1
+		previousWord, atomicDepth, caseDepth = "", 0, 0
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case r == '\n':
+			line++
+
+			continue
+		case r == '-' && next == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			if i < len(runes) {
+				line++
+			}
+
+			continue
+		case r == '/' && next == '*':
+			depth := 0
+			for ; i < len(runes); i++ {
+				if runes[i] == '\n' {
+					line++
+				} else if runes[i] == '/' && i+1 < len(runes) && runes[i+1] == '*' {
+					depth++
+					i++
+				} else if runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+
+			continue
+		case unicode.IsSpace(r):
+			continue
+		}
+
+		if start < 0 {
+			start = i
+			startLine = line
+		}
+
+		switch {
+		case r == ';':
+			if atomicDepth == 0 {
+				flush(i + 1)
+			}
+		case r == '_' || unicode.IsLetter(r):
+			j := i + 1
+			for j < len(runes) && (runes[j] == '_' || runes[j] == '$' || unicode.IsLetter(runes[j]) ||
+				unicode.IsDigit(runes[j])) {
+				j++
+			}
+			word := strings.ToLower(string(runes[i:j]))
+			switch {
+			case word == "atomic" && previousWord == "begin":
+				atomicDepth++
+			case atomicDepth > 0 && word == "case":
+				caseDepth++
+			case atomicDepth > 0 && word == "end" && caseDepth > 0:
+				caseDepth--
+			case atomicDepth > 0 && word == "end":
+				atomicDepth--
+			}
+			previousWord = word
+			i = j - 1
+		case r == '\'' || r == '"':
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\n' {
+					line++
+				} else if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case r == '$':
+			tag, ok := dollarQuoteTag(runes[i:])
+			if !ok {
+				continue
+			}
+			end := indexRunes(runes[i+len(tag):], tag)
+			if end < 0 {
+				end = len(runes) - i - len(tag)
+			}
+			line += strings.Count(string(runes[i+len(tag):i+len(tag)+end]), "\n")
+			i += len(tag) + end + len(tag) - 1
+		}
+	}
+	flush(len(runes))
+
+	return statements
+}
+
+// dollarQuoteTag returns the dollar quote tag, e.g. $body$, at the start of runes.
+func dollarQuoteTag(runes []rune) ([]rune, bool) {
+	for i := 1; i < len(runes); i++ {
+		r := runes[i]
+		if r == '$' {
+			return runes[:i+1], true
+		}
+		if !(r == '_' || unicode.IsLetter(r) || (i > 1 && unicode.IsDigit(r))) {
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+func indexRunes(runes, sub []rune) int {
+	for i := 0; i+len(sub) <= len(runes); i++ {
+		if string(runes[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,133 @@
+package internal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestSplitStatements(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want []internal.Statement
+	}{
+		{
+			name: "empty",
+			sql:  "",
+			want: nil,
+		},
+		{
+			name: "single statement without semicolon",
+			sql:  "SELECT 1",
+			want: []internal.Statement{{SQL: "SELECT 1", Line: 1}},
+		},
+		{
+			name: "multiple statements",
+			sql:  "SELECT 1;\n\nSELECT 2;\nSELECT 3;",
+			want: []internal.Statement{
+				{SQL: "SELECT 1;", Line: 1},
+				{SQL: "SELECT 2;", Line: 3},
+				{SQL: "SELECT 3;", Line: 4},
+			},
+		},
+		{
+			name: "line comments",
+			sql:  "-- a comment; with a semicolon\nSELECT 1; -- trailing;\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "SELECT 1;", Line: 2},
+				{SQL: "SELECT 2;", Line: 3},
+			},
+		},
+		{
+			name: "block comment between statements",
+			sql:  "/* first;\nsecond; */\nSELECT 1;",
+			want: []internal.Statement{{SQL: "SELECT 1;", Line: 3}},
+		},
+		{
+			name: "nested block comments",
+			sql:  "/* outer /* inner; */ still a comment; */ SELECT 1;\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "SELECT 1;", Line: 1},
+				{SQL: "SELECT 2;", Line: 2},
+			},
+		},
+		{
+			name: "quoted strings and identifiers",
+			sql:  "SELECT 'a;b', 'it''s;';\nSELECT \"col;\" FROM \"t\"\"x;\";",
+			want: []internal.Statement{
+				{SQL: "SELECT 'a;b', 'it''s;';", Line: 1},
+				{SQL: "SELECT \"col;\" FROM \"t\"\"x;\";", Line: 2},
+			},
+		},
+		{
+			name: "multi-line string",
+			sql:  "SELECT 'a\nb;';\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "SELECT 'a\nb;';", Line: 1},
+				{SQL: "SELECT 2;", Line: 3},
+			},
+		},
+		{
+			name: "dollar quotes",
+			sql:  "CREATE FUNCTION f() RETURNS int AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "CREATE FUNCTION f() RETURNS int AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;", Line: 1},
+				{SQL: "SELECT 2;", Line: 6},
+			},
+		},
+		{
+			name: "tagged dollar quotes containing other tags",
+			sql:  "DO $body$ BEGIN PERFORM $$;$$; END $body$;\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "DO $body$ BEGIN PERFORM $$;$$; END $body$;", Line: 1},
+				{SQL: "SELECT 2;", Line: 2},
+			},
+		},
+		{
+			name: "begin atomic function body",
+			sql: "CREATE FUNCTION f(a int) RETURNS int LANGUAGE sql\nBEGIN ATOMIC\n  SELECT 1;\n" +
+				"  SELECT CASE WHEN a > 0 THEN a ELSE 0 END;\nEND;\nSELECT 2;",
+			want: []internal.Statement{
+				{
+					SQL: "CREATE FUNCTION f(a int) RETURNS int LANGUAGE sql\nBEGIN ATOMIC\n  SELECT 1;\n" +
+						"  SELECT CASE WHEN a > 0 THEN a ELSE 0 END;\nEND;",
+					Line: 1,
+				},
+				{SQL: "SELECT 2;", Line: 6},
+			},
+		},
+		{
+			name: "begin and end outside of function bodies",
+			sql:  "BEGIN;\nSELECT CASE WHEN true THEN 1 END;\nEND;",
+			want: []internal.Statement{
+				{SQL: "BEGIN;", Line: 1},
+				{SQL: "SELECT CASE WHEN true THEN 1 END;", Line: 2},
+				{SQL: "END;", Line: 3},
+			},
+		},
+		{
+			name: "positional parameters are not dollar quotes",
+			sql:  "PREPARE p AS SELECT $1;\nSELECT 2;",
+			want: []internal.Statement{
+				{SQL: "PREPARE p AS SELECT $1;", Line: 1},
+				{SQL: "SELECT 2;", Line: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := internal.SplitStatements(tt.sql)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitStatements() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
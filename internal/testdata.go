@@ -0,0 +1,460 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	testdataExtensionCSV  = ".csv"
+	testdataExtensionJSON = ".json"
+)
+
+var (
+	ErrUnknownTestdataSet = errors.New("unknown testdata set")
+	errInvalidTestdata    = errors.New("invalid testdata")
+)
+
+// TestdataSetsDir is the directory in the testdata directory which contains a directory for every testdata set.
+const TestdataSetsDir = "sets"
+
+// FindTestdataSets returns the names of the testdata sets, which are the directories in the sets directory of the
+// testdata directory.
+func FindTestdataSets(testdataDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(testdataDir, TestdataSetsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read testdata sets directory: %w", err)
+	}
+
+	var sets []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sets = append(sets, entry.Name())
+		}
+	}
+
+	return sets, nil
+}
+
+// FindTestdataFiles returns the testdata files of the migration with the version, which are the files whose names
+// start with the zero-padded version. The files in the testdata directory and its subdirectories, except for the
+// sets directory, are shared by all sets and come first, followed by the files of the set, if one is given.
+func FindTestdataFiles(testdataDir, set string, migrationVersion int) ([]string, error) {
+	prefix := fmt.Sprintf("%03d", migrationVersion)
+	setsDir := filepath.Join(testdataDir, TestdataSetsDir)
+
+	files, err := findTestdataFiles(testdataDir, setsDir, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == "" {
+		return files, nil
+	}
+
+	setDir := filepath.Join(setsDir, set)
+	if info, err := os.Stat(setDir); set != filepath.Base(set) || err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTestdataSet, set)
+	}
+
+	setFiles, err := findTestdataFiles(setDir, "", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(files, setFiles...), nil
+}
+
+// VerifyTestdataSet returns an error if a file of the testdata set doesn't start with the version of a migration, as it
+// would never be inserted.
+func VerifyTestdataSet(testdataDir, set string, migrationFiles []string) error {
+	versions := map[uint64]struct{}{}
+	for _, file := range migrationFiles {
+		versions[uint64(GetMigrationNumber(file))] = struct{}{}
+	}
+
+	files, err := findTestdataFiles(filepath.Join(testdataDir, TestdataSetsDir, set), "", "")
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, file := range files {
+		match := regexpTestdataIndex.FindStringSubmatch(filepath.Base(file))
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("%q doesn't start with a migration version", file))
+
+			continue
+		}
+		version, _ := strconv.ParseUint(match[1], 10, 32)
+		if _, ok := versions[version]; !ok {
+			problems = append(problems, fmt.Sprintf("%q belongs to migration %s, which doesn't exist", file, match[1]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: set %q: %s", errInvalidTestdata, set, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// findTestdataFiles returns the files in dir and its subdirectories whose names start with prefix, skipping the
+// directory skipDir.
+func findTestdataFiles(dir, skipDir, prefix string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && p == skipDir {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), prefix) {
+			files = append(files, p)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to find testdata: %w", err)
+	}
+
+	return files, nil
+}
+
+// IsTestdataDataFile returns whether the testdata file contains rows of a table instead of SQL.
+func IsTestdataDataFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+
+	return ext == testdataExtensionCSV || ext == testdataExtensionJSON
+}
+
+// InsertTestdata inserts the testdata files into the database of the DSN in the given order. CSV and JSON files are
+// loaded into the table named by the file, "NNN_[schema.]table.csv". Consecutive CSV and JSON files are ordered so
+// that referenced tables are loaded first. onFile is called before a file is inserted.
+func InsertTestdata(ctx context.Context, dsn string, files []string, onFile func(file string)) error {
+	dataFiles := 0
+	for _, file := range files {
+		if IsTestdataDataFile(file) {
+			dataFiles++
+		}
+	}
+
+	var conn *pgx.Conn
+	if dataFiles > 0 {
+		var err error
+		conn, err = pgx.Connect(ctx, dsn)
+		if err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		}
+		defer func() {
+			_ = conn.Close(ctx)
+		}()
+
+		references, err := queryTestdataReferences(ctx, conn)
+		if err != nil {
+			return err
+		}
+		files, err = orderTestdataFiles(files, references)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		if onFile != nil {
+			onFile(file)
+		}
+		if IsTestdataDataFile(file) {
+			err := loadTestdataDataFile(ctx, conn, file)
+			if err != nil {
+				return fmt.Errorf("failed to load %q: %w", filepath.Base(file), err)
+			}
+
+			continue
+		}
+		err := ExecuteSQLFile(ctx, dsn, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// testdataTable returns the schema and table of a data file.
+func testdataTable(file string) (schema, table string, err error) {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	i := strings.Index(name, "_")
+	if i < 0 || i == len(name)-1 {
+		return "", "", fmt.Errorf("%w: %q doesn't name a table", errInvalidTestdata, filepath.Base(file))
+	}
+	name = trimSquashedTestdataIndexes(name[i+1:])
+	if name == "" {
+		return "", "", fmt.Errorf("%w: %q doesn't name a table", errInvalidTestdata, filepath.Base(file))
+	}
+
+	if parts := strings.SplitN(name, ".", 2); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+
+	return "public", name, nil
+}
+
+// orderTestdataFiles orders the consecutive data files of the testdata files with orderTestdataReferences. SQL files
+// keep their position, because they may insert the rows the data files after them reference.
+func orderTestdataFiles(files []string, references map[string][]string) ([]string, error) {
+	ordered := make([]string, 0, len(files))
+	var dataFiles []string
+	for i, file := range files {
+		if IsTestdataDataFile(file) {
+			dataFiles = append(dataFiles, file)
+		}
+		if len(dataFiles) > 0 && (i == len(files)-1 || !IsTestdataDataFile(files[i+1])) {
+			var err error
+			dataFiles, err = orderTestdataReferences(dataFiles, references)
+			if err != nil {
+				return nil, err
+			}
+			ordered = append(ordered, dataFiles...)
+			dataFiles = nil
+		}
+		if !IsTestdataDataFile(file) {
+			ordered = append(ordered, file)
+		}
+	}
+
+	return ordered, nil
+}
+
+// queryTestdataReferences returns the tables referenced by foreign keys by the qualified names of the tables.
+func queryTestdataReferences(ctx context.Context, conn *pgx.Conn) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT rn.nspname || '.' || r.relname, fn.nspname || '.' || f.relname
+		FROM pg_catalog.pg_constraint c
+		JOIN pg_catalog.pg_class r ON r.oid = c.conrelid
+		JOIN pg_catalog.pg_namespace rn ON rn.oid = r.relnamespace
+		JOIN pg_catalog.pg_class f ON f.oid = c.confrelid
+		JOIN pg_catalog.pg_namespace fn ON fn.oid = f.relnamespace
+		WHERE c.contype = 'f' AND c.conrelid <> c.confrelid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	references := map[string][]string{}
+	for rows.Next() {
+		var table, referenced string
+		err = rows.Scan(&table, &referenced)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key: %w", err)
+		}
+		references[table] = append(references[table], referenced)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", rows.Err())
+	}
+
+	return references, nil
+}
+
+// orderTestdataReferences orders the data files so that the tables referenced by foreign keys are loaded before the
+// tables referencing them. Otherwise, and for cyclic references, the order of the files is kept.
+func orderTestdataReferences(files []string, references map[string][]string) ([]string, error) {
+	tables := make([]string, len(files))
+	for i, file := range files {
+		schema, table, err := testdataTable(file)
+		if err != nil {
+			return nil, err
+		}
+		tables[i] = schema + "." + table
+	}
+
+	// A file can be loaded once no file which is not loaded yet contains a table it references
+	loaded := make([]bool, len(files))
+	ordered := make([]string, 0, len(files))
+	for len(ordered) < len(files) {
+		progress := false
+		for i := range files {
+			if loaded[i] || !testdataReferencesLoaded(tables, loaded, references[tables[i]], i) {
+				continue
+			}
+			loaded[i] = true
+			ordered = append(ordered, files[i])
+			progress = true
+		}
+		if !progress {
+			for i := range files {
+				if !loaded[i] {
+					loaded[i] = true
+					ordered = append(ordered, files[i])
+				}
+			}
+		}
+	}
+
+	return ordered, nil
+}
+
+func testdataReferencesLoaded(tables []string, loaded []bool, referenced []string, self int) bool {
+	for _, r := range referenced {
+		for j, table := range tables {
+			if j != self && !loaded[j] && table == r {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func loadTestdataDataFile(ctx context.Context, conn *pgx.Conn, file string) error {
+	schema, table, err := testdataTable(file)
+	if err != nil {
+		return err
+	}
+
+	var columns []string
+	var data io.Reader
+	var format string
+	if strings.ToLower(filepath.Ext(file)) == testdataExtensionCSV {
+		columns, data, err = readTestdataCSV(file)
+		format = "csv, header true"
+	} else {
+		columns, data, err = readTestdataJSON(file)
+		format = "text"
+	}
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	_, err = conn.PgConn().CopyFrom(ctx, data, fmt.Sprintf(
+		"COPY %s (%s) FROM STDIN WITH (format %s)",
+		pgx.Identifier{schema, table}.Sanitize(),
+		quoteIdentifiers(columns),
+		format,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+
+	return nil
+}
+
+// readTestdataCSV returns the columns of the header and the content of the file.
+func readTestdataCSV(file string) ([]string, io.Reader, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read testdata: %w", err)
+	}
+
+	header, err := csv.NewReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	return header, bytes.NewReader(data), nil
+}
+
+// readTestdataJSON reads an array of objects and returns the keys of all objects as columns and the rows in the text
+// format of COPY, in which missing keys and nulls are NULL.
+func readTestdataJSON(file string) ([]string, io.Reader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read testdata: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	var objects []map[string]interface{}
+	err = decoder.Decode(&objects)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %q must contain an array of objects: %v", errInvalidTestdata, filepath.Base(file), err)
+	}
+
+	keys := map[string]struct{}{}
+	for _, o := range objects {
+		for k := range o {
+			keys[k] = struct{}{}
+		}
+	}
+	columns := make([]string, 0, len(keys))
+	for k := range keys {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+
+	var buf bytes.Buffer
+	for _, o := range objects {
+		for i, column := range columns {
+			if i > 0 {
+				buf.WriteByte('\t')
+			}
+			value, err := copyTextValue(o[column])
+			if err != nil {
+				return nil, nil, err
+			}
+			buf.WriteString(value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	return columns, &buf, nil
+}
+
+// copyTextValue returns the JSON value in the text format of COPY. Objects and arrays are written as JSON, so they
+// can be loaded into json and jsonb columns.
+func copyTextValue(value interface{}) (string, error) {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return `\N`, nil
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = fmt.Sprintf("%t", v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode value: %w", err)
+		}
+		s = string(b)
+	}
+
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s), nil
+}
+
+func quoteIdentifiers(identifiers []string) string {
+	quoted := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		quoted[i] = pgx.Identifier{identifier}.Sanitize()
+	}
+
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+//nolint:gochecknoglobals
+var testdataReferences = map[string][]string{
+	"public.orders":    {"public.users", "public.products"},
+	"public.products":  {"shop.categories"},
+	"shop.categories":  {"shop.categories"},
+	"public.addresses": {"public.users"},
+}
+
+func TestOrderTestdataFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "only sql files",
+			files: []string{"testdata/003_b.sql", "testdata/003_a.sql"},
+			want:  []string{"testdata/003_b.sql", "testdata/003_a.sql"},
+		},
+		{
+			name:  "sql file creating rows for a data file",
+			files: []string{"testdata/003_a-users.sql", "testdata/003_orders.csv", "testdata/003_z.sql"},
+			want:  []string{"testdata/003_a-users.sql", "testdata/003_orders.csv", "testdata/003_z.sql"},
+		},
+		{
+			name: "data files ordered between sql files",
+			files: []string{
+				"testdata/003_a.sql",
+				"testdata/003_orders.csv",
+				"testdata/003_products.json",
+				"testdata/003_shop.categories.csv",
+				"testdata/003_t.sql",
+				"testdata/003_users.csv",
+				"testdata/sets/dev/003_addresses.csv",
+				"testdata/sets/dev/003_users.csv",
+			},
+			want: []string{
+				"testdata/003_a.sql",
+				"testdata/003_shop.categories.csv",
+				"testdata/003_products.json",
+				"testdata/003_orders.csv",
+				"testdata/003_t.sql",
+				"testdata/003_users.csv",
+				"testdata/sets/dev/003_users.csv",
+				"testdata/sets/dev/003_addresses.csv",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := orderTestdataFiles(tt.files, testdataReferences)
+			if err != nil {
+				t.Fatalf("orderTestdataFiles() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderTestdataFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderTestdataReferences(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "referenced tables first",
+			files: []string{"003_orders.csv", "003_products.json", "003_shop.categories.csv", "003_users.csv"},
+			want:  []string{"003_shop.categories.csv", "003_users.csv", "003_products.json", "003_orders.csv"},
+		},
+		{
+			name:  "order kept without references",
+			files: []string{"003_users.csv", "003_addresses.csv", "003_tags.csv"},
+			want:  []string{"003_users.csv", "003_addresses.csv", "003_tags.csv"},
+		},
+		{
+			name:  "squashed testdata",
+			files: []string{"042_003_orders.csv", "042_003_users.csv"},
+			want:  []string{"042_003_users.csv", "042_003_orders.csv"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := orderTestdataReferences(tt.files, testdataReferences)
+			if err != nil {
+				t.Fatalf("orderTestdataReferences() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderTestdataReferences() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
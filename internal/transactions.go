@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// NoTransactionDirective in a migration file makes trek execute its statements one by one instead of in a
+// transaction, which is required for statements like CREATE INDEX CONCURRENTLY.
+const NoTransactionDirective = "-- trek:no-transaction"
+
+// noTransactionRules match the normalized statements which can't run in a transaction. ALTER TYPE ... ADD VALUE can
+// run in a transaction since PostgreSQL 12, but the new value can't be used before the transaction is committed.
+//
+//nolint:gochecknoglobals
+var noTransactionRules = []*regexp.Regexp{
+	regexp.MustCompile(`^create (unique )?index concurrently\b`),
+	regexp.MustCompile(`^drop index concurrently\b`),
+	regexp.MustCompile(`^reindex\b.*\bconcurrently\b`),
+	regexp.MustCompile(`^alter table\b.*\bdetach partition\b.*\bconcurrently\b`),
+	regexp.MustCompile(`^alter type\b.*\badd value\b`),
+	regexp.MustCompile(`^(vacuum|alter system)\b`),
+	regexp.MustCompile(`^(create|drop) (database|tablespace)\b`),
+}
+
+// regexpTransactionControl matches the normalized statements which start or end a transaction.
+//
+//nolint:gochecknoglobals
+var regexpTransactionControl = regexp.MustCompile(`^(begin|start transaction|commit|end|rollback|abort)\b`)
+
+// HasTransactionControl returns whether the migration controls its transactions itself with statements like BEGIN
+// and COMMIT. Only the statements split by SplitStatements are checked, so e.g. the END of a BEGIN ATOMIC function
+// body isn't one of them.
+func HasTransactionControl(sql string) bool {
+	for _, s := range SplitStatements(sql) {
+		normalized := strings.ToLower(regexpWhitespace.ReplaceAllString(strings.TrimSpace(s.SQL), " "))
+		if regexpTransactionControl.MatchString(normalized) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasNoTransactionDirective returns whether the migration contains the NoTransactionDirective on its own line.
+func HasNoTransactionDirective(sql string) bool {
+	for _, line := range strings.Split(sql, "\n") {
+		if strings.TrimSpace(line) == NoTransactionDirective {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequiresNoTransaction returns whether the statement must be executed outside of a transaction.
+func RequiresNoTransaction(statement string) bool {
+	normalized := strings.ToLower(regexpWhitespace.ReplaceAllString(strings.TrimSpace(statement), " "))
+	for _, rule := range noTransactionRules {
+		if rule.MatchString(normalized) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MigrationSegment is a part of a migration which is either executed in a transaction or statement by statement.
+type MigrationSegment struct {
+	SQL           string
+	NoTransaction bool
+}
+
+// SplitMigrationSegments splits the migration into consecutive segments of statements which can and which can't run in
+// a transaction, keeping the order of the statements. A migration which needs no split is returned unchanged as
+// single segment.
+func SplitMigrationSegments(sql string) []MigrationSegment {
+	var segments []MigrationSegment
+	var statements []string
+	noTransaction := false
+
+	for i, s := range SplitStatements(sql) {
+		requiresNoTransaction := RequiresNoTransaction(s.SQL)
+		if i > 0 && requiresNoTransaction != noTransaction {
+			segments = append(segments, MigrationSegment{
+				SQL:           strings.Join(statements, "\n"),
+				NoTransaction: noTransaction,
+			})
+			statements = nil
+		}
+		statements = append(statements, s.SQL)
+		noTransaction = requiresNoTransaction
+	}
+
+	if len(segments) == 0 {
+		return []MigrationSegment{{SQL: sql, NoTransaction: noTransaction}}
+	}
+
+	return append(segments, MigrationSegment{
+		SQL:           strings.Join(statements, "\n"),
+		NoTransaction: noTransaction,
+	})
+}
@@ -0,0 +1,177 @@
+package internal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stack11/trek/internal"
+)
+
+func TestRequiresNoTransaction(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		statement string
+		want      bool
+	}{
+		{"CREATE INDEX CONCURRENTLY users_name ON users (name);", true},
+		{"create unique index\n  concurrently users_email on users (email);", true},
+		{"CREATE INDEX users_name ON users (name);", false},
+		{"DROP INDEX CONCURRENTLY users_name;", true},
+		{"DROP INDEX users_name;", false},
+		{"REINDEX INDEX CONCURRENTLY users_name;", true},
+		{"ALTER TABLE events DETACH PARTITION events_2020 CONCURRENTLY;", true},
+		{"ALTER TABLE events DETACH PARTITION events_2020;", false},
+		{"ALTER TYPE status ADD VALUE 'archived';", true},
+		{"ALTER TYPE status RENAME VALUE 'old' TO 'new';", false},
+		{"VACUUM users;", true},
+		{"ALTER SYSTEM SET work_mem = '64MB';", true},
+		{"CREATE DATABASE app;", true},
+		{"DROP TABLESPACE fast;", true},
+		{"SELECT 'CREATE INDEX CONCURRENTLY';", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.statement, func(t *testing.T) {
+			t.Parallel()
+
+			if got := internal.RequiresNoTransaction(tt.statement); got != tt.want {
+				t.Errorf("RequiresNoTransaction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMigrationSegments(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want []internal.MigrationSegment
+	}{
+		{
+			name: "empty",
+			sql:  "",
+			want: []internal.MigrationSegment{{SQL: "", NoTransaction: false}},
+		},
+		{
+			name: "only transactional statements",
+			sql:  "CREATE TABLE users (id int);\n-- a comment\nALTER TABLE users ADD COLUMN name text;\n",
+			want: []internal.MigrationSegment{
+				{SQL: "CREATE TABLE users (id int);\n-- a comment\nALTER TABLE users ADD COLUMN name text;\n"},
+			},
+		},
+		{
+			name: "only non-transactional statements",
+			sql:  "CREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);\n",
+			want: []internal.MigrationSegment{
+				{SQL: "CREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);\n", NoTransaction: true},
+			},
+		},
+		{
+			name: "non-transactional statement in between",
+			sql: "CREATE TABLE t (a int);\nALTER TABLE t ADD COLUMN b int;\n" +
+				"CREATE INDEX CONCURRENTLY a ON t (a);\nDROP INDEX CONCURRENTLY old;\n" +
+				"ALTER TABLE t ADD COLUMN c int;\n",
+			want: []internal.MigrationSegment{
+				{SQL: "CREATE TABLE t (a int);\nALTER TABLE t ADD COLUMN b int;"},
+				{SQL: "CREATE INDEX CONCURRENTLY a ON t (a);\nDROP INDEX CONCURRENTLY old;", NoTransaction: true},
+				{SQL: "ALTER TABLE t ADD COLUMN c int;"},
+			},
+		},
+		{
+			name: "non-transactional statement first",
+			sql:  "ALTER TYPE status ADD VALUE 'archived';\nUPDATE items SET status = 'archived';\n",
+			want: []internal.MigrationSegment{
+				{SQL: "ALTER TYPE status ADD VALUE 'archived';", NoTransaction: true},
+				{SQL: "UPDATE items SET status = 'archived';"},
+			},
+		},
+		{
+			name: "statements in dollar quotes",
+			sql:  "DO $$ BEGIN EXECUTE 'VACUUM t'; END $$;\nCREATE INDEX CONCURRENTLY a ON t (a);\n",
+			want: []internal.MigrationSegment{
+				{SQL: "DO $$ BEGIN EXECUTE 'VACUUM t'; END $$;"},
+				{SQL: "CREATE INDEX CONCURRENTLY a ON t (a);", NoTransaction: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := internal.SplitMigrationSegments(tt.sql)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitMigrationSegments() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasNoTransactionDirective(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want bool
+	}{
+		{"on its own line", "-- trek:no-transaction\nVACUUM t;", true},
+		{"indented", "  -- trek:no-transaction  \nVACUUM t;", true},
+		{"missing", "VACUUM t;", false},
+		{"in a comment", "-- no -- trek:no-transaction\nVACUUM t;", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := internal.HasNoTransactionDirective(tt.sql); got != tt.want {
+				t.Errorf("HasNoTransactionDirective() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasTransactionControl(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		sql  string
+		want bool
+	}{
+		{"begin and commit", "BEGIN;\nCREATE TABLE t (a int);\nCOMMIT;", true},
+		{"start transaction and end", "start  transaction isolation level serializable;\nUPDATE t SET a = 1;\nend;", true},
+		{"rollback", "UPDATE t SET a = 1;\nROLLBACK;", true},
+		{"abort", "ABORT;", true},
+		{"no transaction control", "CREATE TABLE t (a int);\nINSERT INTO t VALUES (1);", false},
+		{"savepoint", "SAVEPOINT s;\nROLLBACK TO SAVEPOINT s;", true},
+		{"function body", "CREATE FUNCTION f() RETURNS void AS $$\nBEGIN\n  COMMIT;\nEND;\n$$ LANGUAGE plpgsql;", false},
+		{"do block", "DO $$ BEGIN PERFORM 1; END $$;", false},
+		{
+			"begin atomic function body",
+			"CREATE PROCEDURE p() LANGUAGE sql BEGIN ATOMIC\n  INSERT INTO t VALUES (1);\n  DELETE FROM t;\nEND;",
+			false,
+		},
+		{"comment", "-- BEGIN;\n/* COMMIT; */\nSELECT 1;", false},
+		{"string", "SELECT 'BEGIN; COMMIT;';", false},
+		{"column named like a keyword", "SELECT beginning FROM t;", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := internal.HasTransactionControl(tt.sql); got != tt.want {
+				t.Errorf("HasTransactionControl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jackc/pgx/v4"
+)
+
+// DefaultPostgresVersion is the major version of the embedded databases if postgres_version isn't set.
+const DefaultPostgresVersion = "13"
+
+//nolint:gochecknoglobals
+var embeddedPostgresVersions = map[string]embeddedpostgres.PostgresVersion{
+	"10": embeddedpostgres.V10,
+	"11": embeddedpostgres.V11,
+	"12": embeddedpostgres.V12,
+	"13": embeddedpostgres.V13,
+	"14": embeddedpostgres.V14,
+}
+
+var (
+	regexpPostgresVersion       = regexp.MustCompile(`^(\d+)\.\d+\.\d+$`)
+	regexpPostgresClientVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)`)
+	regexpPostgresServerVersion = regexp.MustCompile(`^(\d+)`)
+)
+
+var ErrIncompatibleClient = errors.New("incompatible PostgreSQL client")
+
+// ValidatePostgresVersion returns whether the version is a supported major version, e.g. "14", or a full version of
+// the embedded PostgreSQL binaries, e.g. "14.3.0".
+func ValidatePostgresVersion(version string) bool {
+	if _, ok := embeddedPostgresVersions[version]; ok {
+		return true
+	}
+
+	return regexpPostgresVersion.MatchString(version)
+}
+
+// GetPostgresVersion returns the version of the embedded databases.
+func (c *Config) GetPostgresVersion() embeddedpostgres.PostgresVersion {
+	if c.PostgresVersion == "" {
+		return embeddedPostgresVersions[DefaultPostgresVersion]
+	}
+	if v, ok := embeddedPostgresVersions[c.PostgresVersion]; ok {
+		return v
+	}
+
+	return embeddedpostgres.PostgresVersion(c.PostgresVersion)
+}
+
+// ServerMajorVersion returns the major version of the server of the connection.
+func ServerMajorVersion(conn *pgx.Conn) (int, error) {
+	version := conn.PgConn().ParameterStatus("server_version")
+	match := regexpPostgresServerVersion.FindStringSubmatch(version)
+	if match == nil {
+		//nolint:goerr113
+		return 0, fmt.Errorf("failed to parse server version %q", version)
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse server version %q: %w", version, err)
+	}
+
+	return major, nil
+}
+
+// CheckClientVersions validates that the local pg_dump and psql can be used with a server of the major version.
+// pg_dump refuses to dump servers newer than itself, so it is an error, while psql mostly works and is only a warning.
+// Clients which aren't installed are skipped, because they are only needed by some projects.
+func CheckClientVersions(serverMajor int) error {
+	for _, client := range []string{"pg_dump", "psql"} {
+		clientMajor, err := postgresClientMajorVersion(client)
+		if errors.Is(err, exec.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if clientMajor >= serverMajor {
+			continue
+		}
+		if client == "pg_dump" {
+			return fmt.Errorf(
+				"%w: %s version %d is older than the embedded PostgreSQL version %d",
+				ErrIncompatibleClient,
+				client,
+				clientMajor,
+				serverMajor,
+			)
+		}
+		log.Printf("Warning: %s version %d is older than the embedded PostgreSQL version %d\n",
+			client,
+			clientMajor,
+			serverMajor,
+		)
+	}
+
+	return nil
+}
+
+func postgresClientMajorVersion(client string) (int, error) {
+	path, err := exec.LookPath(client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find %s: %w", client, err)
+	}
+
+	//nolint:gosec
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s version: %w", client, err)
+	}
+
+	match := regexpPostgresClientVersion.FindStringSubmatch(string(out))
+	if match == nil {
+		//nolint:goerr113
+		return 0, fmt.Errorf("failed to parse %s version %q", client, strings.TrimSpace(string(out)))
+	}
+
+	//nolint:wrapcheck
+	return strconv.Atoi(match[1])
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchedDir is a directory watched for file changes.
+type WatchedDir struct {
+	Path      string
+	Recursive bool
+}
+
+// Watch watches the directories for file changes and calls onChange with the changed files once no further changes
+// happened for the debounce duration. This way the multiple events of an editor saving a file result in a single
+// call. Only the files for which relevant returns true are considered. Directories which don't exist are skipped.
+// Watch blocks until ctx is done.
+//
+//nolint:gocognit,cyclop
+func Watch(
+	ctx context.Context,
+	dirs []WatchedDir,
+	debounce time.Duration,
+	relevant func(path string) bool,
+	onChange func(paths []string),
+) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	recursive := map[string]bool{}
+	for _, dir := range dirs {
+		err = addWatchedDir(watcher, dir)
+		if err != nil {
+			return err
+		}
+		recursive[filepath.Clean(dir.Path)] = dir.Recursive
+	}
+
+	isRecursive := func(path string) bool {
+		for dir, r := range recursive {
+			if r && (path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	pending := map[string]struct{}{}
+	var timer *time.Timer
+	var timerC <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Op&fsnotify.Create == fsnotify.Create && isRecursive(filepath.Dir(event.Name)) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					err = addWatchedDir(watcher, WatchedDir{Path: event.Name, Recursive: true})
+					if err != nil {
+						log.Printf("Failed to watch %q: %v\n", event.Name, err)
+					}
+				}
+			}
+
+			if event.Op == fsnotify.Chmod || !relevant(event.Name) {
+				continue
+			}
+
+			pending[event.Name] = struct{}{}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(debounce)
+			timerC = timer.C
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Failed to watch files: %v\n", err)
+		case <-timerC:
+			timer = nil
+			timerC = nil
+
+			paths := make([]string, 0, len(pending))
+			for p := range pending {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			pending = map[string]struct{}{}
+
+			onChange(paths)
+		}
+	}
+}
+
+func addWatchedDir(watcher *fsnotify.Watcher, dir WatchedDir) error {
+	if _, err := os.Stat(dir.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if !dir.Recursive {
+		err := watcher.Add(dir.Path)
+		if err != nil {
+			return fmt.Errorf("failed to watch %q: %w", dir.Path, err)
+		}
+
+		return nil
+	}
+
+	err := filepath.WalkDir(dir.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			err = watcher.Add(path)
+			if err != nil {
+				return fmt.Errorf("failed to watch %q: %w", path, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch %q: %w", dir.Path, err)
+	}
+
+	return nil
+}